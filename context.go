@@ -15,46 +15,129 @@
 package web
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/goincremental/dal"
-	"github.com/gorilla/context"
 )
 
+// GetContext retrieves a value stored on the request's context
 func GetContext(r *http.Request, key interface{}) interface{} {
-	return context.Get(r, key)
+	return r.Context().Value(key)
 }
 
+// SetContext stores a value on the request's context.  The request is
+// updated in place, so the value is seen by everything holding r as well as
+// by anything given r.Context(), and is released along with the request.
 func SetContext(r *http.Request, key, val interface{}) {
-	context.Set(r, key, val)
+	*r = *WithContext(r, key, val)
 }
 
-type contextKey int
+// WithContext returns a shallow copy of r whose context carries val, leaving
+// r unchanged
+func WithContext(r *http.Request, key, val interface{}) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), key, val))
+}
+
+// ContextValue retrieves the value stored on the request's context under
+// key, reporting false if there is none or it is not a T
+func ContextValue[T any](r *http.Request, key interface{}) (T, bool) {
+	v, ok := r.Context().Value(key).(T)
+	return v, ok
+}
+
+// Key is a typed key for a value stored on the request context.  Every key
+// created with NewKey is distinct, so keys defined by applications cannot
+// collide with each other or with the keys used by this package.  The zero
+// Key is unusable, and panics if it is used.
+type Key[T any] struct {
+	id *keyID
+}
+
+type keyID struct {
+	name string
+}
 
-const dbKey contextKey = 0
-const rendererKey contextKey = 4
-const sessionKey contextKey = 5
-const sessionStoreKey contextKey = 6
+func (k *keyID) String() string {
+	return k.name
+}
+
+// NewKey creates a new key for values of type T.  The name is only used to
+// describe the key in error messages.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{id: &keyID{name: name}}
+}
+
+// key returns the identity of the key, panicking for the zero Key, as every
+// zero Key would otherwise share the same values
+func (k Key[T]) key() *keyID {
+	if k.id == nil {
+		panic("web: Key used without being created by NewKey")
+	}
+	return k.id
+}
+
+// Get retrieves the value stored under the key, reporting false if there is
+// none
+func (k Key[T]) Get(r *http.Request) (T, bool) {
+	return ContextValue[T](r, k.key())
+}
+
+// MustGet retrieves the value stored under the key, and panics if there is
+// none
+func (k Key[T]) MustGet(r *http.Request) T {
+	v, ok := k.Get(r)
+	if !ok {
+		panic("web: no value on request for key " + k.id.name)
+	}
+	return v
+}
+
+// Set stores val under the key on the request's context, updating the
+// request in place in the same way as SetContext
+func (k Key[T]) Set(r *http.Request, val T) {
+	SetContext(r, k.key(), val)
+}
+
+// With returns a shallow copy of r carrying val under the key, leaving r
+// unchanged
+func (k Key[T]) With(r *http.Request, val T) *http.Request {
+	return WithContext(r, k.key(), val)
+}
+
+func (k Key[T]) String() string {
+	if k.id == nil {
+		return "<zero Key>"
+	}
+	return k.id.name
+}
+
+var (
+	dbKey           = NewKey[dal.Database]("db")
+	rendererKey     = NewKey[Renderer]("renderer")
+	sessionKey      = NewKey[Session]("session")
+	sessionStoreKey = NewKey[Store]("sessionStore")
+)
 
 func GetDb(r *http.Request) *dal.Database {
-	if rv := GetContext(r, dbKey); rv != nil {
-		db := rv.(dal.Database)
+	if db, ok := dbKey.Get(r); ok {
+		if GetSpan(r) != nil {
+			db = &tracedDatabase{Database: db, r: r}
+		}
 		return &db
 	}
 	return nil
 }
 
 func SetDb(r *http.Request, val dal.Database) {
-	SetContext(r, dbKey, val)
+	dbKey.Set(r, val)
 }
 
 func GetRenderer(r *http.Request) Renderer {
-	if rv := GetContext(r, rendererKey); rv != nil {
-		return rv.(Renderer)
-	}
-	return nil
+	rv, _ := rendererKey.Get(r)
+	return rv
 }
 
 func SetRenderer(r *http.Request, val Renderer) {
-	SetContext(r, rendererKey, val)
+	rendererKey.Set(r, val)
 }
@@ -0,0 +1,101 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+type account struct{ Name string }
+
+func TestKey(t *testing.T) {
+	key := web.NewKey[*account]("account")
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, ok := key.Get(r); ok {
+		t.Error("value found before it was set")
+	}
+
+	ann := &account{"ann"}
+	key.Set(r, ann)
+	if got, ok := key.Get(r); !ok || got != ann {
+		t.Errorf("got %v %v", got, ok)
+	}
+	if got := key.MustGet(r); got != ann {
+		t.Errorf("MustGet got %v", got)
+	}
+
+	// keys with the same name and type are still distinct
+	other := web.NewKey[*account]("account")
+	if _, ok := other.Get(r); ok {
+		t.Error("value found under another key")
+	}
+
+	bob := &account{"bob"}
+	copied := key.With(r, bob)
+	if got, _ := key.Get(copied); got != bob {
+		t.Errorf("copy got %v", got)
+	}
+	if got, _ := key.Get(r); got != ann {
+		t.Errorf("With changed the request to %v", got)
+	}
+}
+
+func TestContextValue(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	web.SetContext(r, "n", 3)
+	if n, ok := web.ContextValue[int](r, "n"); !ok || n != 3 {
+		t.Errorf("got %v %v", n, ok)
+	}
+	if _, ok := web.ContextValue[string](r, "n"); ok {
+		t.Error("int returned as a string")
+	}
+	if _, ok := web.ContextValue[int](r, "missing"); ok {
+		t.Error("missing value found")
+	}
+}
+
+func TestKeyMustGetPanics(t *testing.T) {
+	defer func() {
+		msg, _ := recover().(string)
+		if !strings.Contains(msg, "account") {
+			t.Errorf("panicked with %q", msg)
+		}
+	}()
+	web.NewKey[*account]("account").MustGet(httptest.NewRequest("GET", "/", nil))
+}
+
+func TestZeroKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	for name, use := range map[string]func(key web.Key[int]){
+		"Get":     func(key web.Key[int]) { key.Get(r) },
+		"MustGet": func(key web.Key[int]) { key.MustGet(r) },
+		"Set":     func(key web.Key[int]) { key.Set(r, 1) },
+		"With":    func(key web.Key[int]) { key.With(r, 1) },
+	} {
+		func() {
+			defer func() {
+				msg, _ := recover().(string)
+				if !strings.Contains(msg, "NewKey") {
+					t.Errorf("%s on the zero Key panicked with %q", name, msg)
+				}
+			}()
+			use(web.Key[int]{})
+		}()
+	}
+}
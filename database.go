@@ -0,0 +1,135 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/goincremental/dal"
+)
+
+// Database is middleware that clones the connection for each request, and
+// makes the named database on the clone available through GetDb.  The clone
+// is closed once the request has been handled, even if a handler panics.
+func Database(conn dal.Connection, name string) Middleware {
+	return MiddlewareFunc(func(rw http.ResponseWriter,
+		r *http.Request, next http.HandlerFunc) {
+		c := conn.Clone()
+		defer c.Close()
+		SetDb(r, c.DB(name))
+		next(rw, r)
+	})
+}
+
+// ErrNoDatabase is returned by WithTransaction when there is no database on
+// the request
+var ErrNoDatabase = errors.New("web: no database on request")
+
+// Transactional is implemented by databases which can group operations
+// across collections into a transaction
+type Transactional interface {
+	Begin() (Transaction, error)
+}
+
+// Transaction is a transaction started by Transactional.Begin.  Operations
+// must be made through the database returned by DB to be part of it.
+type Transaction interface {
+	DB() dal.Database
+	Commit() error
+	Rollback() error
+}
+
+const transactionAttempts = 3
+
+// WithTransaction runs f with the database from the request.  When the
+// database is Transactional f runs inside a transaction, which is committed
+// if f returns nil and rolled back otherwise.  The whole transaction is
+// retried when it fails with a transient error, but when only the outcome of
+// the commit is unknown just the commit is retried, as f may already have
+// been applied.  Databases which do not support transactions run f once,
+// without any atomicity.
+func WithTransaction(r *http.Request, f func(db *dal.Database) error) error {
+	db, ok := dbKey.Get(r)
+	if !ok {
+		return ErrNoDatabase
+	}
+	t, ok := db.(Transactional)
+	if !ok {
+		return f(GetDb(r))
+	}
+
+	var err error
+	for attempt := 0; attempt < transactionAttempts; attempt++ {
+		if err = runTransaction(r, t, f); !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func runTransaction(r *http.Request, t Transactional,
+	f func(db *dal.Database) error) (err error) {
+	tx, err := t.Begin()
+	if err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if !done {
+			tx.Rollback()
+		}
+	}()
+
+	db := tx.DB()
+	if GetSpan(r) != nil {
+		db = &tracedDatabase{Database: db, r: r}
+	}
+	if err = f(&db); err != nil {
+		return err
+	}
+	done = true
+	for attempt := 0; attempt < transactionAttempts; attempt++ {
+		if err = tx.Commit(); !hasErrorLabel(err, "UnknownTransactionCommitResult") {
+			return err
+		}
+	}
+	return err
+}
+
+// hasErrorLabel reports whether err carries one of the error labels used by
+// mongodb
+func hasErrorLabel(err error, label string) bool {
+	var labelled interface{ HasErrorLabel(string) bool }
+	return errors.As(err, &labelled) && labelled.HasErrorLabel(label)
+}
+
+// isTransient reports whether err indicates that the whole transaction may
+// succeed if retried, either through its error label or by being a
+// temporary error
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var labelled interface{ HasErrorLabel(string) bool }
+	if errors.As(err, &labelled) {
+		return labelled.HasErrorLabel("TransientTransactionError")
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		return temporary.Temporary()
+	}
+	return false
+}
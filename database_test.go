@@ -0,0 +1,148 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/webtest"
+)
+
+type labelledError string
+
+func (e labelledError) Error() string                   { return string(e) }
+func (e labelledError) HasErrorLabel(label string) bool { return label == string(e) }
+
+// scriptedDatabase is a Transactional database whose commits fail with the
+// errors given, in order
+type scriptedDatabase struct {
+	dal.Database
+	commits []error
+	begun   int
+}
+
+func (d *scriptedDatabase) Begin() (web.Transaction, error) {
+	d.begun++
+	return &scriptedTransaction{d}, nil
+}
+
+type scriptedTransaction struct{ d *scriptedDatabase }
+
+func (t *scriptedTransaction) DB() dal.Database { return t.d.Database }
+func (t *scriptedTransaction) Rollback() error  { return nil }
+
+func (t *scriptedTransaction) Commit() error {
+	if len(t.d.commits) == 0 {
+		return nil
+	}
+	err := t.d.commits[0]
+	t.d.commits = t.d.commits[1:]
+	return err
+}
+
+func runWithTransaction(db dal.Database) (calls int, err error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	web.SetDb(r, db)
+	err = web.WithTransaction(r, func(*dal.Database) error {
+		calls++
+		return nil
+	})
+	return
+}
+
+func TestWithTransactionRetriesUnknownCommitOnly(t *testing.T) {
+	unknown := labelledError("UnknownTransactionCommitResult")
+	db := &scriptedDatabase{Database: webtest.NewDatabase(),
+		commits: []error{unknown, unknown}}
+	calls, err := runWithTransaction(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || db.begun != 1 {
+		t.Errorf("f ran %d times in %d transactions, want once", calls, db.begun)
+	}
+}
+
+func TestWithTransactionRetriesTransientErrors(t *testing.T) {
+	db := &scriptedDatabase{Database: webtest.NewDatabase(),
+		commits: []error{labelledError("TransientTransactionError")}}
+	calls, err := runWithTransaction(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || db.begun != 2 {
+		t.Errorf("f ran %d times in %d transactions, want twice", calls, db.begun)
+	}
+}
+
+func TestWithTransactionGivesUp(t *testing.T) {
+	unknown := labelledError("UnknownTransactionCommitResult")
+	db := &scriptedDatabase{Database: webtest.NewDatabase(),
+		commits: []error{unknown, unknown, unknown, unknown}}
+	calls, err := runWithTransaction(db)
+	if !errors.Is(err, unknown) {
+		t.Errorf("got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("f ran %d times", calls)
+	}
+}
+
+func TestWithTransactionWithoutTransactions(t *testing.T) {
+	calls, err := runWithTransaction(webtest.NewDatabase())
+	if err != nil || calls != 1 {
+		t.Errorf("f ran %d times: %v", calls, err)
+	}
+}
+
+// countingConnection counts the clones of a connection which are closed
+type countingConnection struct {
+	dal.Connection
+	clones, closed *int
+}
+
+func (c countingConnection) Clone() dal.Connection {
+	*c.clones++
+	return countingConnection{c.Connection.Clone(), c.clones, c.closed}
+}
+
+func (c countingConnection) Close() {
+	*c.closed++
+	c.Connection.Close()
+}
+
+func TestDatabaseClosesOnPanic(t *testing.T) {
+	var clones, closed int
+	conn := countingConnection{webtest.NewConnection(), &clones, &closed}
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*web.GetDb(r)).C("items").Insert(dal.Q{"n": 1})
+		panic("handler failed")
+	}))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("panicking handler got %d", w.Code)
+	}
+	if clones != 1 || closed != 1 {
+		t.Errorf("closed %d of %d clones", closed, clones)
+	}
+}
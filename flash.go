@@ -0,0 +1,91 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Levels of flash message, which layouts can use to style them
+const (
+	FlashSuccess = "success"
+	FlashInfo    = "info"
+	FlashWarning = "warning"
+	FlashError   = "error"
+)
+
+const flashesKey = "_flashes"
+
+// Flash is a message kept in the session until it is next shown to the user
+type Flash struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// AddFlash adds a message to the session, to be shown on the next page that
+// displays flashes, which is usually the page redirected to after a form is
+// submitted.
+func AddFlash(r *http.Request, level, msg string) {
+	s := GetSession(r)
+	if s == nil {
+		log.Printf("Unable to add flash %q, there is no session", msg)
+		return
+	}
+	// flashes are kept as JSON so that they survive the encoding of any store
+	b, err := json.Marshal(Flash{Level: level, Message: msg})
+	if err != nil {
+		log.Printf("Unable to add flash %q: %v", msg, err)
+		return
+	}
+	s.AddFlash(string(b), flashesKey)
+}
+
+// Flashes returns the flash messages in the session and removes them, so that
+// each message is only shown once
+func Flashes(r *http.Request) []Flash {
+	return sessionFlashes(GetSession(r))
+}
+
+func sessionFlashes(s Session) []Flash {
+	if s == nil {
+		return nil
+	}
+	var flashes []Flash
+	for _, v := range s.Flashes(flashesKey) {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var f Flash
+		if err := json.Unmarshal([]byte(str), &f); err == nil {
+			flashes = append(flashes, f)
+		}
+	}
+	return flashes
+}
+
+// templateFlashes is the Flashes template function, which takes either the
+// request or its session, for example [[ range Flashes .Request ]]
+func templateFlashes(v interface{}) []Flash {
+	switch t := v.(type) {
+	case *http.Request:
+		return Flashes(t)
+	case Session:
+		return sessionFlashes(t)
+	}
+	return nil
+}
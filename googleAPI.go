@@ -15,114 +15,114 @@
 package web
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/oauth2"
-	plus "google.golang.org/api/plus/v1"
 )
 
 // GoogleAPI supports quering the google api to get login information about
 // the current user, and call other google APIs on behalf of that user
 type GoogleAPI interface {
 	LoginWithCode(code string) (GoogleUser, error)
+	VerifyIDToken(ctx context.Context, idToken string) (GoogleUser, error)
 }
 
 type googleAPI struct {
 	config *oauth2.Config
+	keys   JWKS
 }
 
-func base64Decode(s string) ([]byte, error) {
-	// add back missing padding
-	switch len(s) % 4 {
-	case 2:
-		s += "=="
-	case 3:
-		s += "="
-	}
-	return base64.URLEncoding.DecodeString(s)
-}
-
-// claimSet represents an IdToken response.
-type claimSet struct {
-	Sub string
-}
-
-// decodeIdToken takes an ID Token and decodes it to fetch the Google+ ID within
-func decodeToken(idToken string) (gplusID string, err error) {
-	// An ID token is a cryptographically-signed JSON object encoded in base 64.
-	// Normally, it is critical that you validate an ID token before you use it,
-	// but since you are communicating directly with Google over an
-	// intermediary-free HTTPS channel and using your Client Secret to
-	// authenticate yourself to Google, you can be confident that the token you
-	// receive really comes from Google and is valid. If your server passes the ID
-	// token to other components of your app, it is extremely important that the
-	// other components validate the token before using it.
-	var set claimSet
-	if idToken != "" {
-		// Check that the padding is correct for a base64decode
-		parts := strings.Split(idToken, ".")
-		if len(parts) < 2 {
-			return "", fmt.Errorf("Malformed ID token")
-		}
-		// Decode the ID token
-		b, err := base64Decode(parts[1])
-		if err != nil {
-			return "", fmt.Errorf("Malformed ID token: %v", err)
-		}
-		err = json.Unmarshal(b, &set)
-		if err != nil {
-			return "", fmt.Errorf("Malformed ID token: %v", err)
-		}
-	}
-	return set.Sub, nil
-}
+// googleCertsURL serves the keys Google signs ID tokens with
+const googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
 
-func (g *googleAPI) LoginWithCode(code string) (GoogleUser, error) {
-	var valid = false
+// googleLoginTimeout limits how long exchanging a code and verifying its ID
+// token can take
+const googleLoginTimeout = 30 * time.Second
 
-	fmt.Printf("%+v\n", g.config)
+// googleIssuers are the issuers Google uses in ID tokens
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+// googleClaims are the claims of a Google ID token
+type googleClaims struct {
+	jwt.RegisteredClaims
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+}
 
-	token, err := g.config.Exchange(oauth2.NoContext, code)
+// VerifyIDToken checks the ID token was signed by Google for this client and
+// has not expired, and returns the user it identifies
+func (g *googleAPI) VerifyIDToken(ctx context.Context, idToken string) (GoogleUser, error) {
+	claims := &googleClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return g.keys.Key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithAudience(g.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Invalid ID token: %v", err)
+	}
+	if !googleIssuers[claims.Issuer] {
+		return nil, fmt.Errorf("Invalid ID token: issued by %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("Invalid ID token: no subject")
 	}
+	return &googleUser{
+		id:            claims.Subject,
+		email:         claims.Email,
+		emailVerified: claims.EmailVerified,
+		name:          claims.Name,
+		picture:       claims.Picture,
+		valid:         true,
+	}, nil
+}
 
-	id, err := decodeToken(token.Extra("id_token").(string))
+func (g *googleAPI) LoginWithCode(code string) (GoogleUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), googleLoginTimeout)
+	defer cancel()
+	token, err := g.config.Exchange(ctx, code)
 	if err != nil {
 		return nil, err
 	}
 
-	client := g.config.Client(oauth2.NoContext, token)
-	service, err := plus.New(client)
-	getme := service.People.Get("me")
-	me, err := getme.Do()
-
-	email := "N/A"
-	for _, e := range me.Emails {
-		if e.Type == "account" {
-			email = e.Value
-		}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("No ID token in the response from Google")
 	}
-	valid = true
-	return &googleUser{id: id, valid: valid, email: email}, nil
+	return g.VerifyIDToken(ctx, idToken)
 }
 
 // GoogleUser provides information about the currently logged in user acording
-// to the google api
+// to the google api, taken from the verified claims of their ID token
 type GoogleUser interface {
 	ID() string
 	Email() string
+	EmailVerified() bool
+	Name() string
+	Picture() string
 	Valid() bool
 }
 
 type googleUser struct {
-	id    string
-	email string
-	valid bool
+	id            string
+	email         string
+	emailVerified bool
+	name          string
+	picture       string
+	valid         bool
 }
 
 func (g *googleUser) ID() string {
@@ -133,14 +133,38 @@ func (g *googleUser) Email() string {
 	return g.email
 }
 
+func (g *googleUser) EmailVerified() bool {
+	return g.emailVerified
+}
+
+func (g *googleUser) Name() string {
+	return g.name
+}
+
+func (g *googleUser) Picture() string {
+	return g.picture
+}
+
 func (g *googleUser) Valid() bool {
 	return g.valid
 }
 
+// GoogleOption configures a GoogleAPI
+type GoogleOption func(*googleAPI)
+
+// GoogleKeys sets the keys ID tokens are verified with, which are fetched
+// from Google by default
+func GoogleKeys(keys JWKS) GoogleOption {
+	return func(g *googleAPI) {
+		g.keys = keys
+	}
+}
+
 // NewGoogleAPI creates a GoogleAPI object.  This should be created
 // once per web server, and then stored on the request using the SetGoogle
 // middleware
-func NewGoogleAPI(id string, secret string, scopes []string) GoogleAPI {
+func NewGoogleAPI(id string, secret string, scopes []string,
+	opts ...GoogleOption) GoogleAPI {
 	authURL := "https://accounts.google.com/o/oauth2/auth"
 	tokenURL := "https://accounts.google.com/o/oauth2/token"
 	config := &oauth2.Config{
@@ -153,25 +177,30 @@ func NewGoogleAPI(id string, secret string, scopes []string) GoogleAPI {
 			TokenURL: tokenURL,
 		}}
 
-	return &googleAPI{config: config}
+	g := &googleAPI{config: config}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.keys == nil {
+		g.keys = NewJWKS(JWKSFromURL(googleCertsURL, nil))
+	}
+	return g
 }
 
-const googleAPIKey contextKey = 7
+var googleAPIKey = NewKey[GoogleAPI]("googleAPI")
 
 // SetGoogleAPI is middleware that ensures the provided GoogleAPI object
 // is made available on the request object
 func SetGoogleAPI(googleAPI GoogleAPI) Middleware {
 	return MiddlewareFunc(func(rw http.ResponseWriter,
 		r *http.Request, next http.HandlerFunc) {
-		SetContext(r, googleAPIKey, googleAPI)
+		googleAPIKey.Set(r, googleAPI)
 		next(rw, r)
 	})
 }
 
 // GetGoogleAPI retrieves the GoogleAPI object from the request context
 func GetGoogleAPI(r *http.Request) GoogleAPI {
-	if rv := GetContext(r, googleAPIKey); rv != nil {
-		return rv.(GoogleAPI)
-	}
-	return nil
+	rv, _ := googleAPIKey.Get(r)
+	return rv
 }
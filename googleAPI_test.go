@@ -0,0 +1,82 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goincremental/web"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signIDToken(key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s, _ := token.SignedString(key)
+	return s
+}
+
+func TestGoogleVerifyIDToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certs.json")
+	os.WriteFile(path, keySet("k1", testRSAKey), 0600)
+	api := web.NewGoogleAPI("client", "secret", nil,
+		web.GoogleKeys(web.NewJWKS(web.JWKSFromFile(path))))
+
+	now := time.Now()
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            "https://accounts.google.com",
+			"aud":            "client",
+			"sub":            "123",
+			"exp":            now.Add(time.Hour).Unix(),
+			"iat":            now.Unix(),
+			"email":          "ann@example.com",
+			"email_verified": true,
+		}
+	}
+	user, err := api.VerifyIDToken(context.Background(), signIDToken(testRSAKey, "k1", claims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID() != "123" || user.Email() != "ann@example.com" || !user.EmailVerified() {
+		t.Errorf("user %+v", user)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bad := map[string]string{
+		"unknown key": signIDToken(testRSAKey, "k2", claims()),
+		"forged":      signIDToken(other, "k1", claims()),
+	}
+	for name, change := range map[string]func(jwt.MapClaims){
+		"audience": func(c jwt.MapClaims) { c["aud"] = "other" },
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://example.com" },
+		"expired":  func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() },
+	} {
+		c := claims()
+		change(c)
+		bad[name] = signIDToken(testRSAKey, "k1", c)
+	}
+	for name, token := range bad {
+		if _, err := api.VerifyIDToken(context.Background(), token); err == nil {
+			t.Errorf("%s token verified", name)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goincremental/dal"
+	"golang.org/x/sync/singleflight"
+)
+
+// HealthCheck reports whether a dependency of the application is healthy.
+// It should return promptly once ctx is done.
+type HealthCheck func(ctx context.Context) error
+
+// HealthChecks holds the checks run by the liveness and readiness endpoints
+// of a Server.  Liveness checks are run by both endpoints, readiness checks
+// only by the readiness endpoint.  Each endpoint responds with 200 when every
+// check passes and 503 otherwise, with the result of each check as JSON.
+//
+// The endpoints are not served until Serve is called, so that they do not
+// take over paths the application uses itself, for example
+//
+//	s.HealthChecks().Serve("/healthz", "/readyz")
+type HealthChecks interface {
+	Middleware
+	Serve(liveness, readiness string)
+	AddLiveness(name string, check HealthCheck)
+	AddReadiness(name string, check HealthCheck)
+	SetTimeout(d time.Duration)
+	SetCacheDuration(d time.Duration)
+}
+
+// HealthResult is the outcome of a single check
+type HealthResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// HealthReport is the JSON body returned by the health endpoints
+type HealthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]HealthResult `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check HealthCheck
+	ready bool
+}
+
+type healthChecks struct {
+	mu        sync.Mutex
+	liveness  string
+	readiness string
+	checks    []namedCheck
+	timeout   time.Duration
+	cacheFor  time.Duration
+	cached    map[string]cachedReport
+}
+
+type cachedReport struct {
+	report  HealthReport
+	expires time.Time
+}
+
+// Serve makes the server respond at the liveness and readiness paths.  An
+// empty path leaves that endpoint off.
+func (h *healthChecks) Serve(liveness, readiness string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness = liveness
+	h.readiness = readiness
+}
+
+func (h *healthChecks) AddLiveness(name string, check HealthCheck) {
+	h.add(namedCheck{name: name, check: check})
+}
+
+func (h *healthChecks) AddReadiness(name string, check HealthCheck) {
+	h.add(namedCheck{name: name, check: check, ready: true})
+}
+
+func (h *healthChecks) add(c namedCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, c)
+	h.cached = map[string]cachedReport{}
+}
+
+// SetTimeout sets how long each check may take before it is reported as
+// failed
+func (h *healthChecks) SetTimeout(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timeout = d
+}
+
+// SetCacheDuration sets how long the results of the checks are reused for,
+// so that frequent probes do not put load on the dependencies being checked
+func (h *healthChecks) SetCacheDuration(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cacheFor = d
+	h.cached = map[string]cachedReport{}
+}
+
+func (h *healthChecks) ServeHTTP(rw http.ResponseWriter, r *http.Request,
+	next http.HandlerFunc) {
+	h.mu.Lock()
+	liveness, readiness := h.liveness, h.readiness
+	h.mu.Unlock()
+	path := r.URL.Path
+	ready := path == readiness
+	if path == "" || (path != liveness && !ready) {
+		next(rw, r)
+		return
+	}
+	report := h.report(r.Context(), r.URL.Path, ready)
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(report)
+}
+
+func (h *healthChecks) report(ctx context.Context, key string,
+	ready bool) HealthReport {
+	h.mu.Lock()
+	if c, ok := h.cached[key]; ok && time.Now().Before(c.expires) {
+		h.mu.Unlock()
+		return c.report
+	}
+	var checks []namedCheck
+	for _, c := range h.checks {
+		if ready || !c.ready {
+			checks = append(checks, c)
+		}
+	}
+	timeout, cacheFor := h.timeout, h.cacheFor
+	h.mu.Unlock()
+
+	report := HealthReport{Status: "ok", Checks: map[string]HealthResult{}}
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c namedCheck) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c.check, timeout)
+		}(i, c)
+	}
+	wg.Wait()
+	for i, c := range checks {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+
+	if cacheFor > 0 {
+		h.mu.Lock()
+		h.cached[key] = cachedReport{report: report, expires: time.Now().Add(cacheFor)}
+		h.mu.Unlock()
+	}
+	return report
+}
+
+// runCheck runs the check with a deadline, reporting it as failed if it
+// panics or does not return in time
+func runCheck(ctx context.Context, check HealthCheck,
+	timeout time.Duration) HealthResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("check panicked: %v", p)
+			}
+		}()
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := HealthResult{Status: "ok", Duration: time.Since(start).String()}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func newHealthChecks() *healthChecks {
+	return &healthChecks{
+		timeout: 5 * time.Second,
+		cached:  map[string]cachedReport{},
+	}
+}
+
+// Pinger is implemented by connections and stores which can report whether
+// their backend is reachable
+type Pinger interface {
+	Ping() error
+}
+
+// DatabaseCheck returns a HealthCheck which checks that the database can be
+// reached through a copy of the connection.  If the connection implements
+// Pinger it is pinged, otherwise a query is run against the database.
+func DatabaseCheck(conn dal.Connection, database string) HealthCheck {
+	return sharedCheck(func() error {
+		c := conn.Clone()
+		defer c.Close()
+		if p, ok := c.(Pinger); ok {
+			return p.Ping()
+		}
+		var result struct{}
+		err := c.DB(database).C("healthcheck").Find(dal.Q{}).One(&result)
+		if err != nil && !errors.Is(err, dal.ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+// SessionStoreCheck returns a HealthCheck which pings the session store.
+// Stores which cannot be pinged are always reported as healthy.
+func SessionStoreCheck(store Store) HealthCheck {
+	p, ok := store.(Pinger)
+	if !ok {
+		return func(ctx context.Context) error {
+			return nil
+		}
+	}
+	return sharedCheck(p.Ping)
+}
+
+// sharedCheck makes a HealthCheck of f, which cannot be given a deadline.
+// A check which times out leaves f running, so checks made while it runs
+// wait for its result rather than starting f again, and a hung backend holds
+// up one goroutine rather than one for every probe.
+func sharedCheck(f func() error) HealthCheck {
+	var running singleflight.Group
+	return func(ctx context.Context) error {
+		done := running.DoChan("check", func() (_ interface{}, err error) {
+			// a panic here would otherwise be raised again by singleflight
+			// where it cannot be recovered
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("check panicked: %v", p)
+				}
+			}()
+			return nil, f()
+		})
+		select {
+		case res := <-done:
+			return res.Err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
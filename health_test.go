@@ -0,0 +1,199 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/webtest"
+)
+
+func TestHealthEndpointsAreOptIn(t *testing.T) {
+	s := web.NewServer()
+	s.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	}))
+	if body := serve(s, "GET", "/healthz").Body.String(); body != "app" {
+		t.Errorf("/healthz served %q before Serve was called", body)
+	}
+
+	s.HealthChecks().Serve("/healthz", "/readyz")
+	s.HealthChecks().AddReadiness("db", func(ctx context.Context) error {
+		return errors.New("down")
+	})
+	if w := serve(s, "GET", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("/healthz %d: %s", w.Code, w.Body)
+	}
+	w := serve(s, "GET", "/readyz")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"down"`) {
+		t.Errorf("/readyz %d: %s", w.Code, w.Body)
+	}
+	if body := serve(s, "GET", "/other").Body.String(); body != "app" {
+		t.Errorf("/other served %q", body)
+	}
+}
+
+func healthServer() (web.Server, web.HealthChecks) {
+	s := web.NewServer()
+	s.UseHandler(http.NotFoundHandler())
+	s.HealthChecks().Serve("/healthz", "/readyz")
+	return s, s.HealthChecks()
+}
+
+func healthReport(t *testing.T, s http.Handler, path string) web.HealthReport {
+	t.Helper()
+	var report web.HealthReport
+	if err := json.NewDecoder(serve(s, "GET", path).Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	s, checks := healthServer()
+	checks.SetTimeout(20 * time.Millisecond)
+	hung := make(chan struct{})
+	defer close(hung)
+	checks.AddLiveness("hung", func(ctx context.Context) error {
+		<-hung
+		return nil
+	})
+	checks.AddLiveness("ok", func(ctx context.Context) error {
+		return nil
+	})
+
+	start := time.Now()
+	report := healthReport(t, s, "/healthz")
+	if time.Since(start) > time.Second {
+		t.Errorf("report took %v", time.Since(start))
+	}
+	if hung := report.Checks["hung"]; report.Status != "fail" || hung.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("report %+v", report)
+	}
+	if report.Checks["ok"].Status != "ok" {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestHealthCheckPanic(t *testing.T) {
+	s, checks := healthServer()
+	checks.AddLiveness("broken", func(ctx context.Context) error {
+		panic("nil map")
+	})
+	report := healthReport(t, s, "/healthz")
+	if broken := report.Checks["broken"]; broken.Status != "fail" || !strings.Contains(broken.Error, "nil map") {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestHealthCheckCache(t *testing.T) {
+	s, checks := healthServer()
+	var runs int32
+	checks.SetCacheDuration(time.Hour)
+	checks.AddLiveness("counted", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	healthReport(t, s, "/healthz")
+	healthReport(t, s, "/healthz")
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("cached check ran %d times", n)
+	}
+	// each endpoint has its own report
+	healthReport(t, s, "/readyz")
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("check ran %d times for both endpoints", n)
+	}
+	// adding a check clears the cache
+	checks.AddLiveness("other", func(ctx context.Context) error {
+		return nil
+	})
+	if report := healthReport(t, s, "/healthz"); len(report.Checks) != 2 {
+		t.Errorf("report %+v", report)
+	}
+	if n := atomic.LoadInt32(&runs); n != 3 {
+		t.Errorf("check ran %d times after adding a check", n)
+	}
+}
+
+func TestLivenessSkipsReadinessChecks(t *testing.T) {
+	s, checks := healthServer()
+	var live, ready int32
+	checks.AddLiveness("live", func(ctx context.Context) error {
+		atomic.AddInt32(&live, 1)
+		return nil
+	})
+	checks.AddReadiness("ready", func(ctx context.Context) error {
+		atomic.AddInt32(&ready, 1)
+		return nil
+	})
+	if report := healthReport(t, s, "/healthz"); len(report.Checks) != 1 {
+		t.Errorf("liveness report %+v", report)
+	}
+	if live != 1 || ready != 0 {
+		t.Errorf("liveness ran %d liveness and %d readiness checks", live, ready)
+	}
+	if report := healthReport(t, s, "/readyz"); len(report.Checks) != 2 {
+		t.Errorf("readiness report %+v", report)
+	}
+	if live != 2 || ready != 1 {
+		t.Errorf("readiness ran %d liveness and %d readiness checks", live, ready)
+	}
+}
+
+// hungConnection is a connection whose clones cannot be made until release
+// is closed
+type hungConnection struct {
+	dal.Connection
+	clones  *int32
+	release chan struct{}
+}
+
+func (c hungConnection) Clone() dal.Connection {
+	atomic.AddInt32(c.clones, 1)
+	<-c.release
+	return c.Connection.Clone()
+}
+
+// Checks of a hung database wait for the first rather than each leaving a
+// goroutine behind
+func TestDatabaseCheckHung(t *testing.T) {
+	var clones int32
+	conn := hungConnection{webtest.NewConnection(), &clones, make(chan struct{})}
+	check := web.DatabaseCheck(conn, "app")
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := check(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("check of a hung database: %v", err)
+		}
+		cancel()
+	}
+	if n := atomic.LoadInt32(&clones); n != 1 {
+		t.Errorf("%d clones made", n)
+	}
+	close(conn.release)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("check once the database is back: %v", err)
+	}
+}
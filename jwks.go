@@ -0,0 +1,208 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// JWKSFetcher fetches a JSON Web Key Set, returning how long it may be
+// cached for, or zero to use the default of an hour
+type JWKSFetcher func(ctx context.Context) ([]byte, time.Duration, error)
+
+// jwksFetchTimeout limits how long fetching a key set can take, so that
+// requests waiting for the keys are not held up by a slow key server
+const jwksFetchTimeout = 10 * time.Second
+
+// JWKSFromURL fetches a key set over http, caching it for as long as the
+// Cache-Control header allows.  A client with a ten second timeout is used
+// if client is nil.
+func JWKSFromURL(url string, client *http.Client) JWKSFetcher {
+	if client == nil {
+		client = &http.Client{Timeout: jwksFetchTimeout}
+	}
+	return func(ctx context.Context) ([]byte, time.Duration, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("Unable to fetch keys from %s: %s", url, res.Status)
+		}
+		b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		return b, maxAge(res.Header.Get("Cache-Control")), err
+	}
+}
+
+var maxAgePattern = regexp.MustCompile(`max-age=(\d+)`)
+
+func maxAge(cacheControl string) time.Duration {
+	m := maxAgePattern.FindStringSubmatch(cacheControl)
+	if m == nil {
+		return 0
+	}
+	seconds, _ := strconv.Atoi(m[1])
+	return time.Duration(seconds) * time.Second
+}
+
+// JWKSFromFile reads a key set from a file, for tests and environments
+// without network access.  The file is read again whenever the keys expire.
+func JWKSFromFile(path string) JWKSFetcher {
+	return func(ctx context.Context) ([]byte, time.Duration, error) {
+		b, err := os.ReadFile(path)
+		return b, 0, err
+	}
+}
+
+// JWKS holds the public keys of a JSON Web Key Set, fetching them again
+// when they expire, and when a token is signed by a key it does not have
+// yet, so that keys can be rotated.  Requests needing the keys at the same
+// time share a single fetch, and known keys are used without waiting for it.
+type JWKS interface {
+	// Key returns the public key with the key id
+	Key(ctx context.Context, kid string) (interface{}, error)
+}
+
+type jwks struct {
+	fetch    JWKSFetcher
+	fetching singleflight.Group
+	mu       sync.Mutex
+	keys     map[string]interface{}
+	// expires is when the keys must be fetched again, and fetched is when
+	// they were last fetched, which limits fetches for unknown keys
+	expires time.Time
+	fetched time.Time
+}
+
+// NewJWKS creates a JWKS of the keys returned by fetch
+func NewJWKS(fetch JWKSFetcher) JWKS {
+	return &jwks{fetch: fetch}
+}
+
+func (k *jwks) Key(ctx context.Context, kid string) (interface{}, error) {
+	k.mu.Lock()
+	now := time.Now()
+	key, ok := k.keys[kid]
+	stale := now.After(k.expires)
+	recent := now.Sub(k.fetched) <= time.Minute
+	k.mu.Unlock()
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && recent {
+		return nil, fmt.Errorf("Unknown key %q", kid)
+	}
+
+	if err := k.refresh(ctx); err != nil {
+		if ok {
+			// keep using a known key while the key server is unavailable
+			return key, nil
+		}
+		return nil, err
+	}
+	k.mu.Lock()
+	key, ok = k.keys[kid]
+	k.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the keys, or waits for a fetch already in progress.  The
+// fetch is shared, so it is not cancelled with ctx but has its own deadline.
+func (k *jwks) refresh(ctx context.Context) error {
+	done := k.fetching.DoChan("keys", func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+		defer cancel()
+		b, ttl, err := k.fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(b)
+		if err != nil {
+			return nil, err
+		}
+		if ttl <= 0 {
+			ttl = time.Hour
+		}
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.keys = keys
+		k.fetched = time.Now()
+		k.expires = k.fetched.Add(ttl)
+		return nil, nil
+	})
+	select {
+	case res := <-done:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseJWKS parses the RSA keys of a key set, which are the keys Google
+// signs ID tokens with
+func parseJWKS(b []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("Invalid key set: %v", err)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid modulus for key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("Invalid exponent for key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goincremental/web"
+)
+
+var testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+// keySet returns a JSON Web Key Set of the public key with the key id
+func keySet(kid string, key *rsa.PrivateKey) []byte {
+	b, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kid": kid,
+		"kty": "RSA",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	return b
+}
+
+func TestJWKSFromURL(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(status)
+		w.Write(keySet("k1", testRSAKey))
+	}))
+	defer server.Close()
+
+	fetch := web.JWKSFromURL(server.URL, nil)
+	b, ttl, err := fetch(context.Background())
+	if err != nil || len(b) == 0 || ttl != 5*time.Minute {
+		t.Errorf("fetched %d bytes to keep for %v: %v", len(b), ttl, err)
+	}
+	key, err := web.NewJWKS(fetch).Key(context.Background(), "k1")
+	if pub, ok := key.(*rsa.PublicKey); err != nil || !ok || !pub.Equal(&testRSAKey.PublicKey) {
+		t.Errorf("key %v: %v", key, err)
+	}
+
+	status = http.StatusInternalServerError
+	if _, _, err := fetch(context.Background()); err == nil {
+		t.Error("error response accepted")
+	}
+}
+
+func TestJWKSSharesFetches(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	keys := web.NewJWKS(func(ctx context.Context) ([]byte, time.Duration, error) {
+		atomic.AddInt32(&fetches, 1)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("keys fetched without a deadline")
+		}
+		<-release
+		return keySet("k1", testRSAKey), 0, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keys.Key(context.Background(), "k1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// a request giving up does not wait for the fetch, or cancel it for
+	// the others
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := keys.Key(ctx, "k1"); err != context.DeadlineExceeded {
+		t.Errorf("cancelled request got %v", err)
+	}
+	close(release)
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("keys fetched %d times", fetches)
+	}
+}
+
+func TestJWKSUnknownKey(t *testing.T) {
+	var fetches int32
+	keys := web.NewJWKS(func(ctx context.Context) ([]byte, time.Duration, error) {
+		atomic.AddInt32(&fetches, 1)
+		return keySet("k1", testRSAKey), 0, nil
+	})
+	keys.Key(context.Background(), "k1")
+	for i := 0; i < 3; i++ {
+		if _, err := keys.Key(context.Background(), "k2"); err == nil {
+			t.Error("unknown key found")
+		}
+	}
+	// the keys were only just fetched, so are not fetched again
+	if fetches != 1 {
+		t.Errorf("keys fetched %d times", fetches)
+	}
+}
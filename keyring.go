@@ -0,0 +1,261 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+)
+
+// SigningKey is a key held by a Keyring.  The hash key signs data, and the
+// optional block key encrypts cookies.
+type SigningKey struct {
+	Hash  []byte
+	Block []byte
+}
+
+// Keyring holds the keys used to sign sessions, cookies and tokens.  Data
+// is always signed with the newest key, and verified with any of the keys,
+// so keys can be rotated by adding a new key ahead of the old ones and
+// removing the old key once everything signed with it has expired.
+type Keyring interface {
+	// Keys returns the keys, newest first
+	Keys() []SigningKey
+	// KeyPairs returns the keys as hash and block key pairs, in the form
+	// taken by NewSessionStore and securecookie
+	KeyPairs() [][]byte
+	// Codecs returns securecookie codecs for the keys
+	Codecs() []securecookie.Codec
+	// Sign returns a signature of data using the newest key
+	Sign(data []byte) string
+	// Verify checks data was signed by any of the keys
+	Verify(data []byte, signature string) bool
+	// Reload loads the keys again from where they came from, and notifies
+	// everything registered with OnReload
+	Reload() error
+	// OnReload registers f to be called whenever the keys change
+	OnReload(f func())
+}
+
+type keyring struct {
+	mu        sync.RWMutex
+	keys      []SigningKey
+	codecs    []securecookie.Codec
+	load      func() ([]SigningKey, error)
+	listeners []func()
+}
+
+// NewKeyring creates a Keyring holding the given keys, newest first.
+// Reloading it has no effect.
+func NewKeyring(keys ...SigningKey) (Keyring, error) {
+	return newKeyring(func() ([]SigningKey, error) {
+		return keys, nil
+	})
+}
+
+// KeyringFromEnv creates a Keyring from the environment variable name,
+// which holds a comma separated list of keys, newest first.  Each key is a
+// base64 encoded hash key, optionally followed by a colon and a base64
+// encoded block key.  Reloading reads the variable again.
+func KeyringFromEnv(name string) (Keyring, error) {
+	return newKeyring(func() ([]SigningKey, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil, fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return parseKeys(strings.Split(v, ","))
+	})
+}
+
+// KeyringFromFile creates a Keyring from a file holding one key per line,
+// newest first, in the same format as KeyringFromEnv.  Blank lines and lines
+// starting with # are ignored.  Reloading reads the file again.
+func KeyringFromFile(path string) (Keyring, error) {
+	return newKeyring(func() ([]SigningKey, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+		return parseKeys(lines)
+	})
+}
+
+func newKeyring(load func() ([]SigningKey, error)) (Keyring, error) {
+	k := &keyring{load: load}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func parseKeys(entries []string) ([]SigningKey, error) {
+	keys := make([]SigningKey, 0, len(entries))
+	for i, entry := range entries {
+		hash, block, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		k := SigningKey{}
+		var err error
+		if k.Hash, err = decodeKey(hash); err != nil {
+			return nil, fmt.Errorf("Invalid hash key %d: %v", i+1, err)
+		}
+		if block != "" {
+			if k.Block, err = decodeKey(block); err != nil {
+				return nil, fmt.Errorf("Invalid block key %d: %v", i+1, err)
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func (k *keyring) Reload() error {
+	keys, err := k.load()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("Keyring needs at least one key")
+	}
+	for i, key := range keys {
+		if len(key.Hash) < 32 {
+			return fmt.Errorf("Hash key %d must be at least 32 bytes", i+1)
+		}
+		switch len(key.Block) {
+		case 0, 16, 24, 32:
+		default:
+			return fmt.Errorf("Block key %d must be 16, 24 or 32 bytes", i+1)
+		}
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.codecs = securecookie.CodecsFromPairs(keyPairs(keys)...)
+	listeners := append([]func(){}, k.listeners...)
+	k.mu.Unlock()
+
+	for _, f := range listeners {
+		f()
+	}
+	return nil
+}
+
+func (k *keyring) OnReload(f func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.listeners = append(k.listeners, f)
+}
+
+func (k *keyring) Keys() []SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]SigningKey(nil), k.keys...)
+}
+
+func (k *keyring) KeyPairs() [][]byte {
+	return keyPairs(k.Keys())
+}
+
+func keyPairs(keys []SigningKey) [][]byte {
+	pairs := make([][]byte, 0, len(keys)*2)
+	for _, key := range keys {
+		pairs = append(pairs, key.Hash, key.Block)
+	}
+	return pairs
+}
+
+func (k *keyring) Codecs() []securecookie.Codec {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.codecs
+}
+
+func (k *keyring) Sign(data []byte) string {
+	k.mu.RLock()
+	key := k.keys[0]
+	k.mu.RUnlock()
+	return base64.RawURLEncoding.EncodeToString(mac(signingKey(key.Hash), data))
+}
+
+func (k *keyring) Verify(data []byte, signature string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	for _, key := range k.Keys() {
+		if hmac.Equal(sig, mac(signingKey(key.Hash), data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey derives the key used by Sign from a hash key, so that data
+// signed by the application can never be passed off as a cookie signed by
+// securecookie with the same hash key, or the other way round
+func signingKey(hash []byte) []byte {
+	return mac(hash, []byte("web.keyring.sign"))
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// SetSignedCookie sets the cookie with its value signed, and encrypted if
+// the newest key has a block key, by the keyring
+func SetSignedCookie(w http.ResponseWriter, keys Keyring, c *http.Cookie) error {
+	encoded, err := securecookie.EncodeMulti(c.Name, c.Value, keys.Codecs()...)
+	if err != nil {
+		return err
+	}
+	signed := *c
+	signed.Value = encoded
+	http.SetCookie(w, &signed)
+	return nil
+}
+
+// SignedCookie returns the value of a cookie set with SetSignedCookie, which
+// may have been signed by any of the keys in the keyring
+func SignedCookie(r *http.Request, keys Keyring, name string) (string, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	var value string
+	err = securecookie.DecodeMulti(name, c.Value, &value, keys.Codecs()...)
+	return value, err
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+func encodeKey(c byte, n int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{c}, n))
+}
+
+func TestKeyringRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	oldKey := encodeKey('a', 32)
+	newKey := encodeKey('b', 32) + ":" + encodeKey('c', 16)
+	os.WriteFile(path, []byte("# session keys\n"+oldKey+"\n"), 0600)
+	kr, err := web.KeyringFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := web.NewStore(web.StoreOptions{Type: web.StoreMemory, Keyring: kr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, _ := saveSession(t, store, map[interface{}]interface{}{"a": "b"}).Cookie("sid")
+	// sessions are cached on the request, so each load needs a new one
+	request := func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		return r
+	}
+	signature := kr.Sign([]byte("data"))
+
+	// a new key is added ahead of the old one
+	os.WriteFile(path, []byte(newKey+"\n"+oldKey+"\n"), 0600)
+	if err := kr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kr.Sign([]byte("data")) == signature {
+		t.Error("data is still signed with the old key")
+	}
+	if !kr.Verify([]byte("data"), signature) {
+		t.Error("signature of the old key no longer verifies")
+	}
+	if s, err := store.Get(request(), "sid"); err != nil || s.Values["a"] != "b" {
+		t.Errorf("session of the old key not loaded: %v", err)
+	}
+
+	// then the old key is removed
+	os.WriteFile(path, []byte(newKey+"\n"), 0600)
+	if err := kr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kr.Verify([]byte("data"), signature) {
+		t.Error("signature of a removed key verifies")
+	}
+	if _, err := store.Get(request(), "sid"); err == nil {
+		t.Error("session of a removed key loaded")
+	}
+}
+
+func TestKeyringRejectsShortKeys(t *testing.T) {
+	if _, err := web.NewKeyring(web.SigningKey{Hash: []byte("short")}); err == nil {
+		t.Error("short hash key accepted")
+	}
+	_, err := web.NewKeyring(web.SigningKey{
+		Hash:  bytes.Repeat([]byte("h"), 32),
+		Block: []byte("odd"),
+	})
+	if err == nil {
+		t.Error("block key of the wrong length accepted")
+	}
+	os.Setenv("TEST_KEYRING", "")
+	if _, err := web.KeyringFromEnv("TEST_KEYRING"); err == nil {
+		t.Error("empty environment variable accepted")
+	}
+}
+
+// Sign must not use the hash key itself, which also signs cookies
+func TestKeyringSignUsesSubKey(t *testing.T) {
+	hash := bytes.Repeat([]byte("h"), 32)
+	kr, err := web.NewKeyring(web.SigningKey{Hash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := hmac.New(sha256.New, hash)
+	m.Write([]byte("data"))
+	if kr.Sign([]byte("data")) == base64.RawURLEncoding.EncodeToString(m.Sum(nil)) {
+		t.Error("data is signed with the hash key")
+	}
+}
+
+func TestSignedCookie(t *testing.T) {
+	kr, err := web.NewKeyring(web.SigningKey{Hash: testHashKey, Block: testBlockKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := web.SetSignedCookie(w, kr, &http.Cookie{Name: "c", Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	c := w.Result().Cookies()[0]
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	if v, err := web.SignedCookie(r, kr, "c"); err != nil || v != "v" {
+		t.Errorf("got %q, %v", v, err)
+	}
+
+	c.Value = "x" + c.Value[1:]
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	if _, err := web.SignedCookie(r, kr, "c"); err == nil {
+		t.Error("tampered cookie accepted")
+	}
+}
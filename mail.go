@@ -0,0 +1,204 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	// Text and HTML are the plain text and HTML bodies, either of which may
+	// be empty
+	Text string
+	HTML string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(ctx context.Context, m *Message) error
+}
+
+// MemoryMailer is a Mailer which keeps the messages it is sent, for tests
+type MemoryMailer interface {
+	Mailer
+	// Messages returns the messages sent so far
+	Messages() []Message
+}
+
+type memoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemoryMailer creates a MemoryMailer
+func NewMemoryMailer() MemoryMailer {
+	return &memoryMailer{}
+}
+
+func (m *memoryMailer) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+func (m *memoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Bytes encodes the message in MIME format, with a multipart/alternative
+// body when it has both text and HTML
+func (m *Message) Bytes() ([]byte, error) {
+	for _, addr := range append([]string{m.From}, m.To...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return nil, fmt.Errorf("Invalid email address %q", addr)
+		}
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, fmt.Errorf("Invalid email subject %q", m.Subject)
+	}
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	header("From", m.From)
+	header("To", strings.Join(m.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", newSessionID(), messageIDHost(m.From)))
+	header("MIME-Version", "1.0")
+
+	if m.Text == "" || m.HTML == "" {
+		contentType, body := "text/plain", m.Text
+		if m.HTML != "" {
+			contentType, body = "text/html", m.HTML
+		}
+		header("Content-Type", contentType+"; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	w := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+w.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", m.Text},
+		{"text/html", m.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func messageIDHost(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	if _, host, ok := strings.Cut(from, "@"); ok {
+		return host
+	}
+	return "localhost"
+}
+
+type logMailer struct {
+	logger *log.Logger
+}
+
+// NewLogMailer creates a Mailer which logs messages rather than sending
+// them, for development.  The standard logger is used if logger is nil.
+func NewLogMailer(logger *log.Logger) Mailer {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &logMailer{logger: logger}
+}
+
+func (m *logMailer) Send(ctx context.Context, msg *Message) error {
+	m.logger.Printf("Mail from %s to %s: %s\n%s", msg.From,
+		strings.Join(msg.To, ", "), msg.Subject, msg.Text)
+	return nil
+}
+
+type fileMailer struct {
+	dir string
+	mu  sync.Mutex
+	n   int
+}
+
+// NewFileMailer creates a Mailer which writes each message to its own .eml
+// file in dir rather than sending it, for development
+func NewFileMailer(dir string) (Mailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileMailer{dir: dir}, nil
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	m.n++
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().Format("20060102-150405"), m.n)
+	m.mu.Unlock()
+
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.dir, name), b, 0644)
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+// parseMessage parses the encoded message, returning its headers and its
+// bodies decoded by content type
+func parseMessage(t *testing.T, m *web.Message) (mail.Header, map[string]string) {
+	t.Helper()
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string]string{}
+	decode := func(contentType, encoding string, r io.Reader) {
+		if encoding != "quoted-printable" {
+			t.Errorf("%s is encoded as %q", contentType, encoding)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		bodies[mediaType] = string(body)
+	}
+
+	contentType := msg.Header.Get("Content-Type")
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/alternative" {
+		decode(contentType, msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+		return msg.Header, bodies
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := parts.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		decode(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+	}
+	return msg.Header, bodies
+}
+
+func TestMessageBytes(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	header, bodies := parseMessage(t, &web.Message{
+		From:    "Ann <ann@example.com>",
+		To:      []string{"bob@example.com", "cy@example.com"},
+		Subject: "Café = 50% off",
+		Text:    "Café\n" + long,
+		HTML:    "<p>Café</p>",
+	})
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(header.Get("Subject")); subject != "Café = 50% off" {
+		t.Errorf("subject %q", subject)
+	}
+	if to, _ := header.AddressList("To"); len(to) != 2 {
+		t.Errorf("to %v", to)
+	}
+	if !strings.HasSuffix(header.Get("Message-ID"), "@example.com>") || header.Get("Date") == "" {
+		t.Errorf("headers %v", header)
+	}
+	if bodies["text/plain"] != "Café\r\n"+long || bodies["text/html"] != "<p>Café</p>" {
+		t.Errorf("bodies %q", bodies)
+	}
+
+	_, bodies = parseMessage(t, &web.Message{From: "ann@example.com", To: []string{"bob@example.com"}, HTML: "<p>Hi</p>"})
+	if len(bodies) != 1 || bodies["text/html"] != "<p>Hi</p>" {
+		t.Errorf("HTML only message has bodies %q", bodies)
+	}
+}
+
+// Headers cannot be added through the fields of a message
+func TestMessageHeaderInjection(t *testing.T) {
+	for name, m := range map[string]web.Message{
+		"from":    {From: "ann@example.com\r\nBcc: eve@example.com", To: []string{"bob@example.com"}},
+		"to":      {From: "ann@example.com", To: []string{"bob@example.com\nBcc: eve@example.com"}},
+		"subject": {From: "ann@example.com", To: []string{"bob@example.com"}, Subject: "Hi\r\nBcc: eve@example.com"},
+	} {
+		if b, err := m.Bytes(); err == nil {
+			t.Errorf("%s: encoded as %q", name, b)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Errors returned by MailQueue.Send when a message cannot be queued
+var (
+	ErrMailQueueFull   = errors.New("web: mail queue is full")
+	ErrMailQueueClosed = errors.New("web: mail queue is closed")
+)
+
+// MailQueueOptions configures a MailQueue
+type MailQueueOptions struct {
+	// Workers is the number of messages sent at once, by default 2
+	Workers int
+	// Size is the number of messages that can wait to be sent, by default
+	// 100
+	Size int
+	// Retries is the number of times a failed message is retried, waiting
+	// Backoff before the first retry and twice as long before each one after.
+	// Zero retries three times, and a negative number does not retry at all.
+	// Backoff defaults to a second.
+	Retries int
+	Backoff time.Duration
+}
+
+// MailQueue is a Mailer which sends messages in the background, so that
+// requests do not wait for the mail server.  Send only fails when the
+// message cannot be queued, and messages which still fail after being
+// retried are logged.
+type MailQueue interface {
+	Mailer
+	// Close stops accepting messages and waits for those queued to be sent,
+	// giving up on them when ctx is done
+	Close(ctx context.Context) error
+}
+
+type mailQueue struct {
+	mailer  Mailer
+	opts    MailQueueOptions
+	queue   chan *Message
+	mu      sync.RWMutex
+	closed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// NewMailQueue creates a MailQueue sending messages with mailer
+func NewMailQueue(mailer Mailer, opts MailQueueOptions) MailQueue {
+	if opts.Workers <= 0 {
+		opts.Workers = 2
+	}
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = time.Second
+	}
+	q := &mailQueue{
+		mailer: mailer,
+		opts:   opts,
+		queue:  make(chan *Message, opts.Size),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < opts.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *mailQueue) Send(ctx context.Context, m *Message) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrMailQueueClosed
+	}
+	msg := *m
+	msg.To = append([]string(nil), m.To...)
+	select {
+	case q.queue <- &msg:
+		return nil
+	default:
+		return ErrMailQueueFull
+	}
+}
+
+func (q *mailQueue) work() {
+	defer q.workers.Done()
+	for m := range q.queue {
+		q.send(m)
+	}
+}
+
+// send sends the message, retrying with backoff until it succeeds, runs out
+// of retries or the queue is abandoned
+func (q *mailQueue) send(m *Message) {
+	backoff := q.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := q.mailer.Send(q.ctx, m)
+		if err == nil {
+			return
+		}
+		if attempt >= q.opts.Retries || q.ctx.Err() != nil {
+			log.Printf("Unable to send mail %q to %v after %d attempts: %v",
+				m.Subject, m.To, attempt+1, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-q.ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+func (q *mailQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
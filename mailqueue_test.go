@@ -0,0 +1,147 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goincremental/web"
+)
+
+// scriptedMailer fails the first failures attempts, and waits for release
+// before returning when it is set
+type scriptedMailer struct {
+	mu       sync.Mutex
+	failures int
+	attempts []time.Time
+	sent     []string
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func (m *scriptedMailer) Send(ctx context.Context, msg *web.Message) error {
+	if m.started != nil {
+		m.started <- struct{}{}
+	}
+	if m.release != nil {
+		select {
+		case <-m.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts = append(m.attempts, time.Now())
+	if len(m.attempts) <= m.failures {
+		return errors.New("421 try again later")
+	}
+	m.sent = append(m.sent, msg.Subject)
+	return nil
+}
+
+func (m *scriptedMailer) result() (attempts []time.Time, sent []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts, m.sent
+}
+
+var testMessage = &web.Message{From: "ann@example.com", To: []string{"bob@example.com"}, Subject: "Hi"}
+
+func TestMailQueueRetries(t *testing.T) {
+	backoff := 20 * time.Millisecond
+	mailer := &scriptedMailer{failures: 2}
+	q := web.NewMailQueue(mailer, web.MailQueueOptions{Backoff: backoff})
+	if err := q.Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	attempts, sent := mailer.result()
+	if len(attempts) != 3 || len(sent) != 1 {
+		t.Fatalf("sent %d messages in %d attempts", len(sent), len(attempts))
+	}
+	// the wait doubles after each failure
+	if attempts[1].Sub(attempts[0]) < backoff || attempts[2].Sub(attempts[1]) < 2*backoff {
+		t.Errorf("attempts at %v", attempts)
+	}
+}
+
+func TestMailQueueRetryLimit(t *testing.T) {
+	for retries, want := range map[int]int{-1: 1, 1: 2, 0: 4} {
+		mailer := &scriptedMailer{failures: 10}
+		q := web.NewMailQueue(mailer, web.MailQueueOptions{Retries: retries, Backoff: time.Millisecond})
+		q.Send(context.Background(), testMessage)
+		q.Close(context.Background())
+		if attempts, sent := mailer.result(); len(attempts) != want || len(sent) != 0 {
+			t.Errorf("%d retries made %d attempts", retries, len(attempts))
+		}
+	}
+}
+
+func TestMailQueueClose(t *testing.T) {
+	mailer := &scriptedMailer{release: make(chan struct{})}
+	q := web.NewMailQueue(mailer, web.MailQueueOptions{Workers: 1})
+	for i := 0; i < 3; i++ {
+		q.Send(context.Background(), testMessage)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(mailer.release)
+	}()
+	// the messages already queued are sent before Close returns
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, sent := mailer.result(); len(sent) != 3 {
+		t.Errorf("sent %d of 3 queued messages", len(sent))
+	}
+	if err := q.Send(context.Background(), testMessage); !errors.Is(err, web.ErrMailQueueClosed) {
+		t.Errorf("send after close: %v", err)
+	}
+}
+
+func TestMailQueueCloseGivesUp(t *testing.T) {
+	mailer := &scriptedMailer{release: make(chan struct{})}
+	q := web.NewMailQueue(mailer, web.MailQueueOptions{Workers: 1})
+	q.Send(context.Background(), testMessage)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close got %v", err)
+	}
+}
+
+func TestMailQueueFull(t *testing.T) {
+	mailer := &scriptedMailer{started: make(chan struct{}, 1), release: make(chan struct{})}
+	q := web.NewMailQueue(mailer, web.MailQueueOptions{Workers: 1, Size: 1})
+	defer func() {
+		close(mailer.release)
+		q.Close(context.Background())
+	}()
+	q.Send(context.Background(), testMessage)
+	<-mailer.started
+	if err := q.Send(context.Background(), testMessage); err != nil {
+		t.Errorf("queueing a message: %v", err)
+	}
+	if err := q.Send(context.Background(), testMessage); !errors.Is(err, web.ErrMailQueueFull) {
+		t.Errorf("send to a full queue: %v", err)
+	}
+}
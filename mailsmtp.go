@@ -0,0 +1,131 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTPOptions configures the SMTP Mailer
+type SMTPOptions struct {
+	// Addr is the host and port of the server, such as smtp.example.com:587
+	Addr string
+	// Username and Password authenticate with the server when set
+	Username string
+	Password string
+	// TLS configures STARTTLS, which is used whenever the server offers it
+	TLS *tls.Config
+	// Timeout limits how long sending a message takes when the context has
+	// no deadline.  It defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+type smtpMailer struct {
+	opts SMTPOptions
+	host string
+}
+
+// NewSMTPMailer creates a Mailer which sends messages through an SMTP
+// server, opening a connection for each message
+func NewSMTPMailer(opts SMTPOptions) (Mailer, error) {
+	host, _, err := net.SplitHostPort(opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SMTP address %q: %v", opts.Addr, err)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	return &smtpMailer{opts: opts, host: host}, nil
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg *Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.opts.Timeout)
+		defer cancel()
+	}
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("Invalid from address %q: %v", msg.From, err)
+	}
+	to := make([]string, len(msg.To))
+	for i, addr := range msg.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("Invalid to address %q: %v", addr, err)
+		}
+		to[i] = a.Address
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.opts.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := m.opts.TLS
+		if config == nil {
+			config = &tls.Config{ServerName: m.host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if m.opts.Username != "" {
+		auth := smtp.PlainAuth("", m.opts.Username, m.opts.Password, m.host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
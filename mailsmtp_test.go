@@ -0,0 +1,235 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+// smtpSession is what a smtpServer was sent on one connection
+type smtpSession struct {
+	commands []string
+	data     string
+	tls      bool
+}
+
+// smtpServer is a local SMTP server which accepts every message, offering
+// STARTTLS when it has a certificate, and AUTH once the connection is
+// encrypted.  Recipients containing "reject" are refused.
+type smtpServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	sessions chan *smtpSession
+}
+
+func newSMTPServer(t *testing.T, config *tls.Config) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: l, tls: config, sessions: make(chan *smtpSession, 10)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	session := &smtpSession{}
+	defer func() {
+		conn.Close()
+		s.sessions <- session
+	}()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\r\n"))
+		}
+	}
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		session.commands = append(session.commands, line)
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		switch {
+		case verb == "EHLO":
+			switch {
+			case s.tls != nil && !session.tls:
+				reply("250-localhost", "250-STARTTLS", "250 8BITMIME")
+			case session.tls:
+				reply("250-localhost", "250-AUTH PLAIN", "250 8BITMIME")
+			default:
+				reply("250-localhost", "250 8BITMIME")
+			}
+		case verb == "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, session.tls = tlsConn, bufio.NewReader(tlsConn), true
+		case verb == "AUTH":
+			reply("235 authenticated")
+		case verb == "RCPT" && strings.Contains(line, "reject"):
+			reply("550 no such user")
+		case verb == "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			session.data = data.String()
+			reply("250 queued")
+		case verb == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// testTLS returns the configuration of a server with a certificate for
+// 127.0.0.1, and that of a client trusting it
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(ts.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	return &tls.Config{Certificates: ts.TLS.Certificates},
+		&tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+}
+
+func hasCommand(s *smtpSession, prefix string) bool {
+	for _, c := range s.commands {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newSMTPServer(t, nil)
+	mailer, err := web.NewSMTPMailer(web.SMTPOptions{Addr: server.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &web.Message{
+		From:    "Ann <ann@example.com>",
+		To:      []string{"bob@example.com", "Cy <cy@example.com>"},
+		Subject: "Hello",
+		Text:    "Hello\n.\nBob",
+	}
+	if err := mailer.Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	session := <-server.sessions
+	for _, c := range []string{
+		"EHLO",
+		"MAIL FROM:<ann@example.com>",
+		"RCPT TO:<bob@example.com>",
+		"RCPT TO:<cy@example.com>",
+		"DATA",
+		"QUIT",
+	} {
+		if !hasCommand(session, c) {
+			t.Errorf("%q not sent in %q", c, session.commands)
+		}
+	}
+	if session.tls || hasCommand(session, "AUTH") {
+		t.Errorf("server without STARTTLS got %q", session.commands)
+	}
+	if !strings.Contains(session.data, "Subject: Hello\r\n") ||
+		!strings.Contains(session.data, "Hello\r\n.\r\nBob") {
+		t.Errorf("sent %q", session.data)
+	}
+}
+
+func TestSMTPMailerStartTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	server := newSMTPServer(t, serverTLS)
+	mailer, _ := web.NewSMTPMailer(web.SMTPOptions{
+		Addr:     server.Addr(),
+		Username: "ann",
+		Password: "secret",
+		TLS:      clientTLS,
+	})
+	m := &web.Message{From: "ann@example.com", To: []string{"bob@example.com"}, Text: "Hi"}
+	if err := mailer.Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	session := <-server.sessions
+	if !session.tls || !hasCommand(session, "AUTH PLAIN") || session.data == "" {
+		t.Errorf("sent %q over TLS %v", session.commands, session.tls)
+	}
+
+	// a certificate the client does not trust is not sent the message
+	mailer, _ = web.NewSMTPMailer(web.SMTPOptions{Addr: server.Addr()})
+	if err := mailer.Send(context.Background(), m); err == nil {
+		t.Error("sent to a server with an untrusted certificate")
+	}
+	if session := <-server.sessions; session.data != "" {
+		t.Errorf("untrusted server got %q", session.data)
+	}
+}
+
+func TestSMTPMailerErrors(t *testing.T) {
+	server := newSMTPServer(t, nil)
+	mailer, _ := web.NewSMTPMailer(web.SMTPOptions{Addr: server.Addr()})
+	m := &web.Message{From: "ann@example.com", To: []string{"reject@example.com"}, Text: "Hi"}
+	if err := mailer.Send(context.Background(), m); err == nil {
+		t.Error("refused recipient not reported")
+	}
+	m.To = []string{"not an address"}
+	if err := mailer.Send(context.Background(), m); err == nil {
+		t.Error("invalid recipient accepted")
+	}
+	if _, err := web.NewSMTPMailer(web.SMTPOptions{Addr: "localhost"}); err == nil {
+		t.Error("address without a port accepted")
+	}
+}
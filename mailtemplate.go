@@ -0,0 +1,127 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// MailTemplates renders the bodies and subject of emails from templates
+type MailTemplates interface {
+	// Render fills in the message from the templates called name, bound to
+	// binding
+	Render(m *Message, name string, binding interface{}) error
+}
+
+type mailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+type mailTemplates struct {
+	dir       string
+	mu        sync.Mutex
+	templates map[string]*mailTemplate
+}
+
+// NewMailTemplates creates MailTemplates from the directory, which holds
+// name.html.tmpl and name.txt.tmpl for the HTML and text bodies of each
+// email.  Either may be left out.  The templates use the same delimiters and
+// functions as NewRenderer, and the subject comes from a template they
+// define called subject, for example [[ define "subject" ]]Welcome[[ end ]].
+func NewMailTemplates(dir string) MailTemplates {
+	return &mailTemplates{dir: dir, templates: map[string]*mailTemplate{}}
+}
+
+func (t *mailTemplates) load(name string) (*mailTemplate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tpl, ok := t.templates[name]; ok {
+		return tpl, nil
+	}
+
+	tpl := &mailTemplate{}
+	funcs := TemplateFuncs()
+	htmlFile := filepath.Join(t.dir, name+".html.tmpl")
+	if b, err := os.ReadFile(htmlFile); err == nil {
+		tpl.html, err = htmltemplate.New(name).Delims("[[", "]]").Funcs(funcs).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %v", htmlFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	textFile := filepath.Join(t.dir, name+".txt.tmpl")
+	if b, err := os.ReadFile(textFile); err == nil {
+		tpl.text, err = texttemplate.New(name).Delims("[[", "]]").
+			Funcs(texttemplate.FuncMap(funcs)).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %v", textFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if tpl.html == nil && tpl.text == nil {
+		return nil, fmt.Errorf("No mail templates called %s in %s", name, t.dir)
+	}
+	t.templates[name] = tpl
+	return tpl, nil
+}
+
+func (t *mailTemplates) Render(m *Message, name string, binding interface{}) error {
+	tpl, err := t.load(name)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if tpl.text != nil {
+		if err := tpl.text.Execute(&buf, binding); err != nil {
+			return err
+		}
+		m.Text = buf.String()
+		if s := tpl.text.Lookup("subject"); s != nil {
+			buf.Reset()
+			if err := s.Execute(&buf, binding); err != nil {
+				return err
+			}
+			m.Subject = strings.TrimSpace(buf.String())
+		}
+	}
+	if tpl.html != nil {
+		buf.Reset()
+		if err := tpl.html.Execute(&buf, binding); err != nil {
+			return err
+		}
+		m.HTML = buf.String()
+		if s := tpl.html.Lookup("subject"); s != nil && tpl.text == nil {
+			buf.Reset()
+			if err := s.Execute(&buf, binding); err != nil {
+				return err
+			}
+			// the subject is a header, so undo the escaping for HTML
+			m.Subject = strings.TrimSpace(html.UnescapeString(buf.String()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) web.MailTemplates {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return web.NewMailTemplates(dir)
+}
+
+func TestMailTemplates(t *testing.T) {
+	templates := writeTemplates(t, map[string]string{
+		"welcome.txt.tmpl":  `[[ define "subject" ]] Welcome [[ .Name ]] & co [[ end ]]Hello [[ .Name ]]`,
+		"welcome.html.tmpl": `<p>Hello [[ .Name ]]</p>`,
+		"reset.html.tmpl":   `[[ define "subject" ]]Reset for [[ .Name ]][[ end ]]<p>Reset</p>`,
+	})
+	binding := map[string]string{"Name": "<Bob>"}
+
+	m := &web.Message{}
+	if err := templates.Render(m, "welcome", binding); err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Welcome <Bob> & co" || m.Text != "Hello <Bob>" || m.HTML != "<p>Hello &lt;Bob&gt;</p>" {
+		t.Errorf("rendered %+v", m)
+	}
+
+	// the subject of an HTML template is not left escaped
+	m = &web.Message{}
+	if err := templates.Render(m, "reset", binding); err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Reset for <Bob>" || m.Text != "" || m.HTML != "<p>Reset</p>" {
+		t.Errorf("rendered %+v", m)
+	}
+
+	if err := templates.Render(&web.Message{}, "missing", binding); err == nil {
+		t.Error("missing templates rendered")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// memoryBackend keeps sessions in a map, removing them once their ttl has
+// passed
+type memoryBackend struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{entries: map[string]memoryEntry{}, lastSweep: time.Now()}
+}
+
+func (m *memoryBackend) load(id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[id]
+	if !ok {
+		return nil, nil
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(m.entries, id)
+		return nil, nil
+	}
+	return e.data, nil
+}
+
+func (m *memoryBackend) save(id string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := memoryEntry{data: append([]byte(nil), data...)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	m.entries[id] = e
+	m.sweep()
+	return nil
+}
+
+func (m *memoryBackend) delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, id)
+	return nil
+}
+
+func (m *memoryBackend) ping() error {
+	return nil
+}
+
+// sweep removes expired sessions which have not been loaded since they
+// expired, at most once a minute.  It must be called with the lock held.
+func (m *memoryBackend) sweep() {
+	now := time.Now()
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for id, e := range m.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(m.entries, id)
+		}
+	}
+}
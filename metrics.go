@@ -0,0 +1,129 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects request counts, latencies and response sizes for every
+// request passing through it, along with go runtime stats, and exposes them
+// in the prometheus text format.
+//
+// Metrics is middleware and should be added to the server with Server.Use,
+// before the router, while Handler should be mounted on a route such as
+// /metrics.
+type Metrics interface {
+	Middleware
+	Handler() http.Handler
+}
+
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+}
+
+var metricLabels = []string{"route", "method", "status"}
+
+// metricMethod returns the method label for a request.  Methods other than
+// the standard ones are labelled "other", as clients can send any method and
+// each would otherwise add new series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+func (m *metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request,
+	next http.HandlerFunc) {
+	start := time.Now()
+
+	res, ok := rw.(negroni.ResponseWriter)
+	if !ok {
+		res = negroni.NewResponseWriter(rw)
+	}
+	mr := &matchedRoute{}
+	matchedRouteKey.Set(r, mr)
+
+	next(res, r)
+
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	name := mr.name
+	if name == "" {
+		name = "unmatched"
+	}
+	labels := prometheus.Labels{
+		"route":  name,
+		"method": metricMethod(r.Method),
+		"status": strconv.Itoa(status),
+	}
+	m.requests.With(labels).Inc()
+	m.duration.With(labels).Observe(time.Since(start).Seconds())
+	m.size.With(labels).Observe(float64(res.Size()))
+}
+
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// NewMetrics creates a Metrics middleware with its own registry, so that
+// several servers in one process do not share counters.  Each metric name is
+// prefixed with namespace if one is given.
+func NewMetrics(namespace string) Metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests served.",
+		}, metricLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, metricLabels),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_response_size_bytes",
+			Help:      "Size of HTTP response bodies.",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 6),
+		}, metricLabels),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.size,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+// observedServer serves the router behind the metrics and tracing
+// middleware, as an application would
+func observedServer(m web.Metrics, exp web.Exporter) http.Handler {
+	r := web.NewRouter()
+	r.HandleFunc("/things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}).Name("thing")
+	r.HandleFunc("/other/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Handle("/metrics", m.Handler())
+
+	s := web.NewServer()
+	s.Use(m)
+	s.Use(web.NewTracer("svc", exp))
+	s.UseHandler(r)
+	return s
+}
+
+func serve(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// The router hands a copy of the request to the route, which must still
+// reach the metrics and span added to the original
+func TestMetricsLabelMatchedRoute(t *testing.T) {
+	m := web.NewMetrics("app")
+	s := observedServer(m, web.NewMemoryExporter())
+	serve(s, "GET", "/things/1")
+	serve(s, "GET", "/things/2")
+	serve(s, "GET", "/other/1")
+	serve(s, "GET", "/missing")
+
+	body := serve(s, "GET", "/metrics").Body.String()
+	for _, want := range []string{
+		`app_http_requests_total{method="GET",route="thing",status="204"} 2`,
+		`app_http_requests_total{method="GET",route="/other/{id}",status="200"} 1`,
+		`app_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+// Methods sent by clients cannot add series beyond the standard methods
+func TestMetricsLabelMethod(t *testing.T) {
+	m := web.NewMetrics("app")
+	s := observedServer(m, web.NewMemoryExporter())
+	serve(s, "DELETE", "/other/1")
+	serve(s, "FOO", "/other/1")
+	serve(s, "get", "/other/1")
+
+	body := serve(s, "GET", "/metrics").Body.String()
+	for _, want := range []string{
+		`app_http_requests_total{method="DELETE",route="/other/{id}",status="200"} 1`,
+		`app_http_requests_total{method="other",route="/other/{id}",status="200"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if strings.Contains(body, `method="FOO"`) || strings.Contains(body, `method="get"`) {
+		t.Error("non-standard method used as a label")
+	}
+}
+
+func TestTracerSpansMatchedRoute(t *testing.T) {
+	exp := web.NewMemoryExporter()
+	s := observedServer(web.NewMetrics(""), exp)
+	serve(s, "GET", "/things/1")
+
+	spans := exp.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	route, req := spans[0], spans[1]
+	if route.Name != "route thing" || req.Name != "GET /things/1" {
+		t.Errorf("spans %q and %q", route.Name, req.Name)
+	}
+	if route.ParentSpanID != req.SpanID || route.TraceID != req.TraceID {
+		t.Error("route span is not a child of the request span")
+	}
+}
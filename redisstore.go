@@ -0,0 +1,220 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	redisPoolSize    = 8
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 5 * time.Second
+)
+
+// redisError is an error reply from the server, after which the connection
+// can still be used
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisBackend keeps sessions in redis, talking the redis protocol directly
+// over a small pool of connections
+type redisBackend struct {
+	address  string
+	password string
+	db       int
+	prefix   string
+	idle     chan *redisConn
+}
+
+func newRedisBackend(address, password string, db int,
+	prefix string) *redisBackend {
+	if prefix == "" {
+		prefix = "session_"
+	}
+	return &redisBackend{
+		address:  address,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		idle:     make(chan *redisConn, redisPoolSize),
+	}
+}
+
+func (b *redisBackend) load(id string) ([]byte, error) {
+	reply, err := b.do("GET", b.prefix+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return data, nil
+}
+
+func (b *redisBackend) save(id string, data []byte, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = b.do("SET", b.prefix+id, string(data),
+			"EX", strconv.Itoa(int(ttl/time.Second)))
+	} else {
+		_, err = b.do("SET", b.prefix+id, string(data))
+	}
+	return err
+}
+
+func (b *redisBackend) delete(id string) error {
+	_, err := b.do("DEL", b.prefix+id)
+	return err
+}
+
+func (b *redisBackend) ping() error {
+	_, err := b.do("PING")
+	return err
+}
+
+// do sends a command and reads its reply.  Connections are returned to the
+// pool unless they fail, since a failed connection may have a reply still to
+// be read.
+func (b *redisBackend) do(args ...string) (interface{}, error) {
+	c, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	b.put(c)
+	return reply, err
+}
+
+func (b *redisBackend) get() (*redisConn, error) {
+	select {
+	case c := <-b.idle:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", b.address, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if b.password != "" {
+		if _, err := c.do("AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if b.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(b.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (b *redisBackend) put(c *redisConn) {
+	select {
+	case b.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisIOTimeout))
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a single reply.  Bulk strings are returned as []byte, and
+// nil bulk strings and arrays as nil.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
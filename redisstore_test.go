@@ -0,0 +1,119 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisBackend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b := newRedisBackend(mr.Addr(), "", 0, "")
+
+	if err := b.ping(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := b.load("missing"); data != nil || err != nil {
+		t.Errorf("load of missing session: %q, %v", data, err)
+	}
+
+	// session data is binary, and may contain the protocol's line endings
+	data := []byte("a\r\nb\x00c")
+	if err := b.save("id", data, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.load("id"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("load: %q, %v", got, err)
+	}
+	if ttl := mr.TTL("session_id"); ttl != time.Minute {
+		t.Errorf("ttl %v", ttl)
+	}
+	mr.FastForward(2 * time.Minute)
+	if got, _ := b.load("id"); got != nil {
+		t.Errorf("expired session loaded: %q", got)
+	}
+
+	b.save("id", data, 0)
+	if err := b.delete("id"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("session_id") {
+		t.Error("session not deleted")
+	}
+}
+
+func TestRedisBackendAuthAndDB(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+
+	if err := newRedisBackend(mr.Addr(), "wrong", 0, "").ping(); err == nil {
+		t.Error("ping succeeded with the wrong password")
+	}
+	b := newRedisBackend(mr.Addr(), "secret", 2, "app:")
+	if err := b.save("id", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.DB(2).Get("app:id"); got != "x" {
+		t.Errorf("session not saved in db 2: %q", got)
+	}
+}
+
+func TestRedisBackendKeepsConnectionAfterErrorReply(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b := newRedisBackend(mr.Addr(), "", 0, "")
+	if _, err := b.do("NOSUCHCOMMAND"); !errors.As(err, new(redisError)) {
+		t.Fatalf("got %v, want an error reply", err)
+	}
+	if len(b.idle) != 1 {
+		t.Fatalf("%d idle connections, want the connection kept", len(b.idle))
+	}
+	if err := b.ping(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedisReadReply(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", int64(42)},
+		{"$5\r\nhe\r\no\r\n", []byte("he\r\no")},
+		{"$-1\r\n", nil},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{[]byte("a"), int64(1)}},
+	} {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(test.in))}
+		got, err := c.readReply()
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, %v", test.in, got, err)
+		}
+	}
+
+	for _, in := range []string{"-ERR bad\r\n", "?\r\n", "+OK\n", ""} {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(in))}
+		if _, err := c.readReply(); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
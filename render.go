@@ -19,6 +19,7 @@ import (
 	"html/template"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/goincremental/dal"
@@ -81,21 +82,46 @@ func add(x, y int) int {
 	return x + y
 }
 
+var (
+	templateFuncsMu sync.RWMutex
+	templateFuncs   = template.FuncMap{}
+)
+
+// AddTemplateFuncs makes the functions available to the templates of
+// renderers created afterwards, so should be called before NewRenderer
+func AddTemplateFuncs(funcs template.FuncMap) {
+	templateFuncsMu.Lock()
+	defer templateFuncsMu.Unlock()
+	for name, f := range funcs {
+		templateFuncs[name] = f
+	}
+}
+
+// TemplateFuncs returns the functions available to templates
+func TemplateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		"AsHTML": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"AsDate":  getDateString,
+		"AsID":    getID,
+		"Add":     add,
+		"Flashes": templateFlashes,
+	}
+	templateFuncsMu.RLock()
+	defer templateFuncsMu.RUnlock()
+	for name, f := range templateFuncs {
+		funcs[name] = f
+	}
+	return funcs
+}
+
 func NewRenderer() Renderer {
 	r := render.New(render.Options{
 		Layout:    "index",
 		Delims:    render.Delims{"[[", "]]"},
 		PrefixXML: []byte(xml.Header),
-		Funcs: []template.FuncMap{
-			{
-				"AsHTML": func(s string) template.HTML {
-					return template.HTML(s)
-				},
-				"AsDate": getDateString,
-				"AsID":   getID,
-				"Add":    add,
-			},
-		},
+		Funcs:     []template.FuncMap{TemplateFuncs()},
 	})
 	return &renderer{renderer: r}
 }
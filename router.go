@@ -15,6 +15,7 @@
 package web
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -24,15 +25,23 @@ type Router interface {
 	http.Handler
 	HandleFunc(s string, f func(http.ResponseWriter, *http.Request)) Route
 	Handle(path string, handler http.Handler) Route
+	// SetAuthorizer sets the RouteAuthorizer which checks the roles of
+	// routes restricted with Route.Roles, such as security.AuthorizeRoute.
+	// It should be called before the router serves requests.
+	SetAuthorizer(a RouteAuthorizer)
 }
 
 type Route interface {
 	Methods(s ...string) Route
+	Name(s string) Route
+	Roles(roles ...string) Route
 }
 
 type route struct {
 	Route
-	route *mux.Route
+	route  *mux.Route
+	router *router
+	roles  []string
 }
 
 func (r *route) Methods(s ...string) Route {
@@ -41,19 +50,65 @@ func (r *route) Methods(s ...string) Route {
 	return r
 }
 
+// Name sets the name of the route, which is used to label the route in
+// metrics and traces
+func (r *route) Name(s string) Route {
+	muxRoute := r.route.Name(s)
+	r.route = muxRoute
+	return r
+}
+
+// Roles restricts the route to users with any of the roles.  The roles are
+// checked by the RouteAuthorizer set with Router.SetAuthorizer, and requests
+// are refused if there is none.
+func (r *route) Roles(roles ...string) Route {
+	r.roles = append(r.roles, roles...)
+	return r
+}
+
+// RouteAuthorizer decides whether the request may use a route restricted to
+// roles.  When it refuses the request it writes the response itself.
+type RouteAuthorizer func(w http.ResponseWriter, r *http.Request, roles []string) bool
+
+// authorized wraps the handler of a route so that requests are only passed
+// on when they have one of the roles of the route
+func (r *route) authorized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(r.roles) == 0 {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		authorize := r.router.authorizer
+		if authorize == nil {
+			log.Printf("Refusing request for %s, no RouteAuthorizer is set to check roles",
+				req.URL.Path)
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if authorize(rw, req, r.roles) {
+			h.ServeHTTP(rw, req)
+		}
+	})
+}
+
 type router struct {
 	Router
-	router *mux.Router
+	router     *mux.Router
+	authorizer RouteAuthorizer
 }
 
 func (r *router) HandleFunc(s string, f func(http.ResponseWriter, *http.Request)) Route {
-	muxRoute := r.router.HandleFunc(s, f)
-	return &route{route: muxRoute}
+	return r.Handle(s, http.HandlerFunc(f))
 }
 
 func (r *router) Handle(path string, handler http.Handler) Route {
-	muxRoute := r.router.Handle(path, handler)
-	return &route{route: muxRoute}
+	rt := &route{router: r}
+	rt.route = r.router.Handle(path, matched(rt.authorized(handler)))
+	return rt
+}
+
+func (r *router) SetAuthorizer(a RouteAuthorizer) {
+	r.authorizer = a
 }
 
 func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -69,3 +124,53 @@ func NewRouter() Router {
 func Params(req *http.Request) map[string]string {
 	return mux.Vars(req)
 }
+
+var matchedRouteKey = NewKey[*matchedRoute]("matchedRoute")
+
+// matchedRoute is placed on the request by middleware that needs to know
+// which route handled it, and filled in by the router once a route matches
+type matchedRoute struct {
+	name string
+}
+
+func getMatchedRoute(r *http.Request) *matchedRoute {
+	rv, _ := matchedRouteKey.Get(r)
+	return rv
+}
+
+// matched wraps the handler of a route so that the matched route is recorded
+// on the request, and traced as a child of the request span, while the
+// handler runs
+func matched(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name := routeName(mux.CurrentRoute(req))
+		if m := getMatchedRoute(req); m != nil {
+			m.name = name
+		}
+		if GetSpan(req) == nil {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		s := StartSpan(req, "route "+name)
+		s.SetAttribute("http.route", name)
+		defer s.End()
+		withSpan(req, s, func() {
+			h.ServeHTTP(rw, req)
+		})
+	})
+}
+
+// routeName returns the name of the route, falling back to its path
+// template so that labels stay bounded when routes are not named
+func routeName(r *mux.Route) string {
+	if r == nil {
+		return ""
+	}
+	if name := r.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := r.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return ""
+}
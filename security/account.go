@@ -0,0 +1,324 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// AccountOptions configures the password reset and email verification
+// handlers
+type AccountOptions struct {
+	// SystemID is the system the users belong to
+	SystemID dal.ObjectID
+	// Keys signs the tokens sent to users
+	Keys web.Keyring
+	// Mailer delivers the emails, which are sent From the address
+	Mailer web.Mailer
+	From   string
+	// Templates renders the emails when set, from the templates
+	// password_reset and verify_email bound to a map holding User, Link and
+	// TTL.  Without it plain text emails are sent.
+	Templates web.MailTemplates
+	// BaseURL is the scheme and host of the links in emails, such as
+	// https://example.com
+	BaseURL string
+	// ResetPath and VerifyPath are the paths of the PasswordResetHandler and
+	// VerifyEmailHandler, which default to /password/reset and /email/verify
+	ResetPath  string
+	VerifyPath string
+	// ResetTTL and VerifyTTL are how long the tokens last, by default an hour
+	// and two days
+	ResetTTL  time.Duration
+	VerifyTTL time.Duration
+	// RequestTemplate and ResetTemplate are the forms for requesting a reset
+	// and choosing a new password.  They are bound to a map holding Request,
+	// Token, Sent and Error.
+	RequestTemplate string
+	ResetTemplate   string
+	// DoneURL is where browsers are sent once a password has been reset or
+	// an email verified, which defaults to /
+	DoneURL string
+	// Sessions, when sessions are tracked, is used to log the user out of
+	// every session once their password has been reset.  Their refresh
+	// tokens are always revoked.
+	Sessions web.SessionIndex
+	// Connection and Database are used by PasswordResetRequestHandler, which
+	// looks up the user and sends the email in the background with a clone
+	// of the connection, so they must be set for it
+	Connection dal.Connection
+	Database   string
+}
+
+// accountMailTimeout limits how long handling a password reset request in
+// the background may take
+const accountMailTimeout = time.Minute
+
+func (o AccountOptions) withDefaults() AccountOptions {
+	if o.ResetPath == "" {
+		o.ResetPath = "/password/reset"
+	}
+	if o.VerifyPath == "" {
+		o.VerifyPath = "/email/verify"
+	}
+	if o.ResetTTL == 0 {
+		o.ResetTTL = time.Hour
+	}
+	if o.VerifyTTL == 0 {
+		o.VerifyTTL = 48 * time.Hour
+	}
+	if o.DoneURL == "" {
+		o.DoneURL = "/"
+	}
+	return o
+}
+
+func (o AccountOptions) link(path, token string) string {
+	return strings.TrimSuffix(o.BaseURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// PasswordResetRequestHandler handles a form with an email field, and
+// emails a password reset link to the user with that email.  It responds the
+// same way whether or not there is such a user, so that it cannot be used
+// to find out who has an account, and the user is looked up and the email
+// sent in the background so that neither does the time taken to respond.
+// It panics if opts has no Connection.
+func PasswordResetRequestHandler(opts AccountOptions) http.HandlerFunc {
+	opts = opts.withDefaults()
+	if opts.Connection == nil {
+		panic("security: PasswordResetRequestHandler needs a Connection")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			renderAccount(w, r, opts.RequestTemplate, http.StatusOK, nil)
+			return
+		}
+		email := strings.TrimSpace(r.PostFormValue("email"))
+		go sendPasswordReset(context.WithoutCancel(r.Context()), opts, email)
+		if !wantsHTML(r) {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		renderAccount(w, r, opts.RequestTemplate, http.StatusOK, map[string]interface{}{
+			"Sent": true,
+		})
+	}
+}
+
+// sendPasswordReset emails a password reset link to the user with the
+// email, if there is one, with a clone of the connection as the request's
+// own is closed once it has been handled
+func sendPasswordReset(ctx context.Context, opts AccountOptions, email string) {
+	ctx, cancel := context.WithTimeout(ctx, accountMailTimeout)
+	defer cancel()
+	c := opts.Connection.Clone()
+	defer c.Close()
+	db := c.DB(opts.Database)
+	m, err := passwordResetMail(&db, opts, email)
+	if err == nil && m != nil {
+		err = opts.Mailer.Send(ctx, m)
+	}
+	if err != nil {
+		log.Printf("Unable to send password reset: %v", err)
+	}
+}
+
+// passwordResetMail issues a password reset token to the user with the
+// email, and returns the email with the link to send them, or nil if there
+// is no such user
+func passwordResetMail(db *dal.Database, opts AccountOptions, email string) (*web.Message, error) {
+	user, err := models.GetUserByEmail(db, &opts.SystemID, email)
+	if errors.Is(err, dal.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	token, err := IssueToken(db, opts.Keys, &user, TokenPasswordReset, opts.ResetTTL)
+	if err != nil {
+		return nil, err
+	}
+	link := opts.link(opts.ResetPath, token)
+	return accountMail(opts, &user, "password_reset", link, opts.ResetTTL, &web.Message{
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Hello %s,\n\nTo choose a new password, follow this link within %v:\n\n%s\n\n"+
+			"If you did not ask to reset your password you can ignore this email.\n",
+			user.FirstName, opts.ResetTTL, link),
+	})
+}
+
+// accountMail renders the email from the template when there are
+// templates, and otherwise returns the fallback message
+func accountMail(opts AccountOptions, user *models.User, template, link string,
+	ttl time.Duration, fallback *web.Message) (*web.Message, error) {
+	m := fallback
+	if opts.Templates != nil {
+		m = &web.Message{}
+		err := opts.Templates.Render(m, template, map[string]interface{}{
+			"User": user,
+			"Link": link,
+			"TTL":  ttl,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.From = opts.From
+	m.To = []string{user.Email}
+	return m, nil
+}
+
+// PasswordResetHandler shows the form for choosing a new password to users
+// following a reset link, and sets the password when a form with the token
+// and a password field is posted.
+func PasswordResetHandler(opts AccountOptions) http.HandlerFunc {
+	opts = opts.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		if r.Method != "POST" {
+			renderAccount(w, r, opts.ResetTemplate, http.StatusOK, map[string]interface{}{
+				"Token": token,
+			})
+			return
+		}
+		password := r.PostFormValue("password")
+		if password == "" {
+			renderAccount(w, r, opts.ResetTemplate, http.StatusBadRequest, map[string]interface{}{
+				"Token": token,
+				"Error": "Please choose a password",
+			})
+			return
+		}
+		db := web.GetDb(r)
+		if db == nil {
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		user, err := RedeemToken(db, opts.Keys, opts.SystemID, TokenPasswordReset, token)
+		if err == nil {
+			err = resetPassword(db, opts, user, password)
+		}
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			renderAccount(w, r, opts.ResetTemplate, http.StatusBadRequest, map[string]interface{}{
+				"Error": err.Error(),
+			})
+			return
+		case err != nil:
+			log.Printf("Unable to reset password: %v", err)
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		done(w, r, opts, "Your password has been changed")
+	}
+}
+
+// resetPassword sets the user's new password, and logs them out everywhere
+// else by revoking their sessions and refresh tokens
+func resetPassword(db *dal.Database, opts AccountOptions, user *models.User,
+	password string) error {
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	if err := user.Save(db); err != nil {
+		return err
+	}
+	if opts.Sessions != nil {
+		if err := opts.Sessions.RevokeAll(user.ID); err != nil {
+			return err
+		}
+	}
+	return RevokeRefreshTokens(db, user.ID)
+}
+
+// SendVerificationEmail emails the user a link to verify their email
+// address, to be handled by VerifyEmailHandler
+func SendVerificationEmail(r *http.Request, opts AccountOptions, user *models.User) error {
+	opts = opts.withDefaults()
+	db := web.GetDb(r)
+	if db == nil {
+		return web.ErrNoDatabase
+	}
+	token, err := IssueToken(db, opts.Keys, user, TokenEmailVerification, opts.VerifyTTL)
+	if err != nil {
+		return err
+	}
+	link := opts.link(opts.VerifyPath, token)
+	m, err := accountMail(opts, user, "verify_email", link, opts.VerifyTTL, &web.Message{
+		Subject: "Verify your email address",
+		Text: fmt.Sprintf("Hello %s,\n\nPlease verify your email address by following this link:\n\n%s\n",
+			user.FirstName, link),
+	})
+	if err != nil {
+		return err
+	}
+	return opts.Mailer.Send(r.Context(), m)
+}
+
+// VerifyEmailHandler marks the email of the user a verification link was
+// sent to as verified
+func VerifyEmailHandler(opts AccountOptions) http.HandlerFunc {
+	opts = opts.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := web.GetDb(r)
+		if db == nil {
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		user, err := RedeemToken(db, opts.Keys, opts.SystemID, TokenEmailVerification,
+			r.FormValue("token"))
+		if err == nil {
+			user.EmailVerified = true
+			err = user.Save(db)
+		}
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			respond(w, r, http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Unable to verify email: %v", err)
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		done(w, r, opts, "Your email address has been verified")
+	}
+}
+
+// done finishes a successful request, redirecting browsers with a flash
+func done(w http.ResponseWriter, r *http.Request, opts AccountOptions, msg string) {
+	if !wantsHTML(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if web.GetSession(r) != nil {
+		web.AddFlash(r, web.FlashSuccess, msg)
+	}
+	http.Redirect(w, r, opts.DoneURL, http.StatusSeeOther)
+}
+
+func renderAccount(w http.ResponseWriter, r *http.Request, template string,
+	status int, binding map[string]interface{}) {
+	renderer := web.GetRenderer(r)
+	if renderer == nil || template == "" || !wantsHTML(r) {
+		if status == http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		respond(w, r, status)
+		return
+	}
+	if binding == nil {
+		binding = map[string]interface{}{}
+	}
+	binding["Request"] = r
+	renderer.HTML(w, status, template, binding)
+}
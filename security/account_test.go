@@ -0,0 +1,313 @@
+package security_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+var testSystemID = dal.ObjectIDHex("5f1d7c0a9b1e8a0001a1b2d0")
+
+func init() {
+	// hashing passwords slowly is not what is being tested
+	models.PasswordHashing.Algorithm = models.Bcrypt
+	models.PasswordHashing.BcryptCost = 4
+}
+
+func testKeyring(t *testing.T) web.Keyring {
+	keys, err := web.NewKeyring(web.SigningKey{Hash: []byte(strings.Repeat("k", 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func saveUser(t *testing.T, db dal.Database, email string) *models.User {
+	u := &models.User{SystemID: testSystemID, Email: email, FirstName: "Ann"}
+	if err := u.Save(&db); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// waitForMessages waits for the mailer to have sent n messages, since some
+// are sent in the background
+func waitForMessages(t *testing.T, mailer web.MemoryMailer, n int) []web.Message {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		msgs := mailer.Messages()
+		if len(msgs) >= n || time.Now().After(deadline) {
+			if len(msgs) != n {
+				t.Fatalf("sent %d messages, want %d", len(msgs), n)
+			}
+			return msgs
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func linkToken(t *testing.T, m web.Message) string {
+	t.Helper()
+	i := strings.Index(m.Text, "token=")
+	if i < 0 {
+		t.Fatalf("no link in %q", m.Text)
+	}
+	token, _ := url.QueryUnescape(strings.Fields(m.Text[i+len("token="):])[0])
+	return token
+}
+
+func postForm(h http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPasswordReset(t *testing.T) {
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user := saveUser(t, db, "ann@example.com")
+	mailer := web.NewMemoryMailer()
+	index := web.NewSessionIndex(conn, "app", "sessions", 0)
+	opts := security.AccountOptions{
+		SystemID:   testSystemID,
+		Keys:       testKeyring(t),
+		Mailer:     mailer,
+		BaseURL:    "https://example.com",
+		Sessions:   index,
+		Connection: conn,
+		Database:   "app",
+	}
+	tokens, err := security.NewTokens(security.TokenOptions{
+		SystemID: testSystemID,
+		Keys:     []security.TokenKey{security.HS256Key("k", []byte(strings.Repeat("s", 32)))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := web.NewStore(web.StoreOptions{
+		Type:     web.StoreMemory,
+		KeyPairs: [][]byte{[]byte(strings.Repeat("h", 32))},
+	})
+
+	var pair *security.TokenPair
+	r := web.NewRouter()
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if err := web.SessionLogin(r, user.ID); err != nil {
+			t.Error(err)
+		}
+		if pair, err = tokens.Issue(r, user); err != nil {
+			t.Error(err)
+		}
+	})
+	r.HandleFunc("/password/forgot", security.PasswordResetRequestHandler(opts))
+	r.HandleFunc("/password/reset", security.PasswordResetHandler(opts))
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.Use(web.Sessions("sid", store, web.TrackSessions(index)))
+	s.UseHandler(r)
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	if sessions, _ := index.List(user.ID); len(sessions) != 1 {
+		t.Fatalf("%d sessions after login", len(sessions))
+	}
+
+	if w := postForm(s, "/password/forgot", url.Values{"email": {"nobody@example.com"}}); w.Code != http.StatusAccepted {
+		t.Errorf("unknown email got %d", w.Code)
+	}
+	if w := postForm(s, "/password/forgot", url.Values{"email": {"ann@example.com"}}); w.Code != http.StatusAccepted {
+		t.Errorf("known email got %d", w.Code)
+	}
+	msgs := waitForMessages(t, mailer, 1)
+	if msgs[0].To[0] != "ann@example.com" {
+		t.Errorf("reset sent to %v", msgs[0].To)
+	}
+	token := linkToken(t, msgs[0])
+
+	form := url.Values{"token": {token}, "password": {"new password"}}
+	if w := postForm(s, "/password/reset", form); w.Code != http.StatusNoContent {
+		t.Fatalf("reset got %d: %s", w.Code, w.Body)
+	}
+	form.Set("password", "another")
+	if w := postForm(s, "/password/reset", form); w.Code != http.StatusBadRequest {
+		t.Errorf("reused token got %d", w.Code)
+	}
+
+	got, _ := models.GetUserByEmail(&db, &testSystemID, "ann@example.com")
+	if !got.CheckPassword("new password") || len(got.Tokens) != 0 {
+		t.Errorf("password not reset or token kept: %+v", got)
+	}
+	if sessions, _ := index.List(user.ID); len(sessions) != 0 {
+		t.Errorf("%d sessions left after reset", len(sessions))
+	}
+	refresh := httptest.NewRequest("POST", "/", nil)
+	web.SetDb(refresh, db)
+	if _, err := tokens.Refresh(refresh, pair.RefreshToken); !errors.Is(err, security.ErrInvalidRefreshToken) {
+		t.Errorf("refresh token still works after reset: %v", err)
+	}
+}
+
+// Requesting a reset does no work that depends on whether the user exists
+// before responding, so the request needs no database of its own
+func TestPasswordResetRequestInBackground(t *testing.T) {
+	conn := webtest.NewConnection()
+	saveUser(t, conn.DB("app"), "ann@example.com")
+	mailer := web.NewMemoryMailer()
+	h := security.PasswordResetRequestHandler(security.AccountOptions{
+		SystemID:   testSystemID,
+		Keys:       testKeyring(t),
+		Mailer:     mailer,
+		Connection: conn,
+		Database:   "app",
+	})
+	for _, email := range []string{"nobody@example.com", "ann@example.com"} {
+		if w := postForm(h, "/", url.Values{"email": {email}}); w.Code != http.StatusAccepted {
+			t.Errorf("%s got %d", email, w.Code)
+		}
+	}
+	if msgs := waitForMessages(t, mailer, 1); msgs[0].To[0] != "ann@example.com" {
+		t.Errorf("reset sent to %v", msgs[0].To)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("handler made without a connection")
+		}
+	}()
+	security.PasswordResetRequestHandler(security.AccountOptions{Mailer: mailer})
+}
+
+func TestTokenBoundToEmail(t *testing.T) {
+	db := webtest.NewDatabase()
+	keys := testKeyring(t)
+	user := saveUser(t, db, "ann@example.com")
+	token, err := security.IssueToken(&db, keys, user, security.TokenEmailVerification, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Email = "mallory@example.com"
+	user.Save(&db)
+	_, err = security.RedeemToken(&db, keys, testSystemID, security.TokenEmailVerification, token)
+	if !errors.Is(err, security.ErrInvalidToken) {
+		t.Errorf("token redeemed for a changed email: %v", err)
+	}
+}
+
+func TestTokenRejectsTampering(t *testing.T) {
+	db := webtest.NewDatabase()
+	keys := testKeyring(t)
+	user := saveUser(t, db, "ann@example.com")
+	token, _ := security.IssueToken(&db, keys, user, security.TokenPasswordReset, time.Hour)
+
+	for name, bad := range map[string]string{
+		"purpose":   token,
+		"signature": token[:len(token)-2] + "xx",
+		"format":    "nonsense",
+	} {
+		purpose := security.TokenPasswordReset
+		if name == "purpose" {
+			purpose = security.TokenEmailVerification
+		}
+		if _, err := security.RedeemToken(&db, keys, testSystemID, purpose, bad); !errors.Is(err, security.ErrInvalidToken) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	expired, _ := security.IssueToken(&db, keys, user, security.TokenPasswordReset, -time.Minute)
+	if _, err := security.RedeemToken(&db, keys, testSystemID, security.TokenPasswordReset, expired); !errors.Is(err, security.ErrInvalidToken) {
+		t.Errorf("expired: %v", err)
+	}
+}
+
+// slowReads delays returning the documents found, so that requests made
+// together have all read before any of them writes
+type slowReads struct{ dal.Database }
+
+func (d slowReads) C(name string) dal.Collection { return slowCollection{d.Database.C(name)} }
+
+type slowCollection struct{ dal.Collection }
+
+func (c slowCollection) Find(q dal.Q) dal.Query { return slowQuery{c.Collection.Find(q)} }
+
+type slowQuery struct{ dal.Query }
+
+func (q slowQuery) One(result interface{}) error {
+	err := q.Query.One(result)
+	time.Sleep(20 * time.Millisecond)
+	return err
+}
+
+func TestTokenRedeemedOnce(t *testing.T) {
+	fast := webtest.NewDatabase()
+	keys := testKeyring(t)
+	user := saveUser(t, fast, "ann@example.com")
+	token, _ := security.IssueToken(&fast, keys, user, security.TokenPasswordReset, time.Hour)
+	var db dal.Database = slowReads{fast}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := security.RedeemToken(&db, keys, testSystemID, security.TokenPasswordReset, token)
+			if err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			} else if !errors.Is(err, security.ErrInvalidToken) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if redeemed != 1 {
+		t.Errorf("token redeemed %d times", redeemed)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user := saveUser(t, db, "ann@example.com")
+	mailer := web.NewMemoryMailer()
+	opts := security.AccountOptions{
+		SystemID: testSystemID,
+		Keys:     testKeyring(t),
+		Mailer:   mailer,
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	web.SetDb(r, db)
+	if err := security.SendVerificationEmail(r, opts, user); err != nil {
+		t.Fatal(err)
+	}
+	token := linkToken(t, waitForMessages(t, mailer, 1)[0])
+
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.UseHandler(security.VerifyEmailHandler(opts))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/email/verify?token="+url.QueryEscape(token), nil))
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("verify got %d", w.Code)
+	}
+	got, _ := models.GetUserByEmail(&db, &testSystemID, "ann@example.com")
+	if !got.EmailVerified {
+		t.Error("email not verified")
+	}
+}
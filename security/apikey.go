@@ -0,0 +1,107 @@
+package security
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// APIKeyOptions configures APIKeyAuth
+type APIKeyOptions struct {
+	// SystemID is the system the users belong to
+	SystemID dal.ObjectID
+	// Header is the header API keys can be sent in, as well as the
+	// Authorization header as a bearer token.  It defaults to X-API-Key.
+	Header string
+}
+
+var apiKeyKey = web.NewKey[*models.APIKey]("apiKey")
+
+// APIKeyAuth is middleware which authenticates requests carrying an API
+// key, either as an Authorization bearer token or in the API key header,
+// and makes the key's user available through GetUser.  Requests with an
+// unknown or expired key receive a 401 response, and requests without a key
+// are passed on unchanged.  It needs the Database middleware to run first.
+func APIKeyAuth(opts APIKeyOptions) web.Middleware {
+	if opts.Header == "" {
+		opts.Header = "X-API-Key"
+	}
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		key := requestAPIKey(r, opts.Header)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		db := web.GetDb(r)
+		if db == nil {
+			log.Printf("Unable to check API key, there is no database")
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		user, apiKey, err := models.GetUserByAPIKey(db, &opts.SystemID, key)
+		switch {
+		case errors.Is(err, dal.ErrNotFound) || (err == nil && apiKey.Expired()):
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			respond(w, r, http.StatusUnauthorized)
+			return
+		case err != nil:
+			log.Printf("Unable to check API key: %v", err)
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		SetUser(r, &user)
+		apiKeyKey.Set(r, apiKey)
+		next(w, r)
+	})
+}
+
+// requestAPIKey returns the API key on the request.  Bearer tokens which
+// look like JWTs are left for the token middleware.
+func requestAPIKey(r *http.Request, header string) string {
+	if key := r.Header.Get(header); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(auth[7:])
+	if !models.IsAPIKey(token) && strings.Count(token, ".") == 2 {
+		return ""
+	}
+	return token
+}
+
+// GetAPIKey returns the API key the request was authenticated with, or nil
+// if it was not authenticated with one
+func GetAPIKey(r *http.Request) *models.APIKey {
+	key, _ := apiKeyKey.Get(r)
+	return key
+}
+
+// RequireScopes is middleware which refuses requests authenticated with an
+// API key that lacks any of the scopes.  Requests authenticated in other
+// ways are passed on, so it is used alongside the role and permission
+// middleware.
+func RequireScopes(scopes ...string) web.Middleware {
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		if key := GetAPIKey(r); key != nil {
+			for _, scope := range scopes {
+				if !key.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate",
+						`Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+					respond(w, r, http.StatusForbidden)
+					return
+				}
+			}
+		}
+		next(w, r)
+	})
+}
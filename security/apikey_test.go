@@ -0,0 +1,76 @@
+package security_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	conn := webtest.NewConnection()
+	user := models.User{SystemID: testSystemID, Email: "ann@example.com", APISecret: "legacy"}
+	readKey, _, _ := user.AddAPIKey("ci", []string{"read"}, time.Time{})
+	writeKey, _, _ := user.AddAPIKey("deploy", []string{"write"}, time.Time{})
+	expiredKey, _, _ := user.AddAPIKey("old", []string{"read"}, time.Now().Add(-time.Hour))
+	user.MigrateAPISecret("default")
+	if user.APISecret != "" {
+		t.Error("API secret kept after migration")
+	}
+	db := conn.DB("app")
+	user.Save(&db)
+
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.Use(security.APIKeyAuth(security.APIKeyOptions{SystemID: testSystemID}))
+	s.Use(security.RequireScopes("read"))
+	s.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := security.GetUser(r); u != nil {
+			w.Write([]byte(u.Email))
+		}
+	}))
+	do := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, test := range []struct {
+		header, value string
+		code          int
+		body          string
+	}{
+		{"Authorization", "Bearer " + readKey, http.StatusOK, "ann@example.com"},
+		{"X-API-Key", readKey, http.StatusOK, "ann@example.com"},
+		// the migrated secret keeps the access it had
+		{"X-API-Key", "legacy", http.StatusOK, "ann@example.com"},
+		{"X-API-Key", writeKey, http.StatusForbidden, ""},
+		{"X-API-Key", expiredKey, http.StatusUnauthorized, ""},
+		{"X-API-Key", "unknown", http.StatusUnauthorized, ""},
+		// bearer tokens which are not API keys are left for other middleware
+		{"Authorization", "Bearer a.b.c", http.StatusOK, ""},
+	} {
+		w := do(test.header, test.value)
+		if w.Code != test.code || w.Code == http.StatusOK && w.Body.String() != test.body {
+			t.Errorf("%s %s: got %d %q", test.header, test.value, w.Code, w.Body)
+		}
+	}
+}
+
+func TestRemoveAPIKey(t *testing.T) {
+	user := models.User{}
+	_, key, _ := user.AddAPIKey("ci", nil, time.Time{})
+	if !user.RemoveAPIKey(key.ID) || len(user.APIKeys) != 0 {
+		t.Error("key not removed")
+	}
+	if user.RemoveAPIKey(key.ID) {
+		t.Error("key removed twice")
+	}
+}
@@ -0,0 +1,98 @@
+package security
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// Authenticate is middleware which loads the user logged in to the session
+// with web.SessionLogin, looking them up within the system, and makes them
+// available through GetUser.  It needs the Sessions and Database middleware
+// to run first.
+func Authenticate(systemID dal.ObjectID) web.Middleware {
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		if GetUser(r) == nil {
+			if id, ok := web.SessionUserID(r); ok {
+				// a user removed since they logged in is simply not logged in
+				err := loadUser(r, systemID, id)
+				if err != nil && !errors.Is(err, dal.ErrNotFound) {
+					log.Printf("Unable to authenticate user %s: %v", id.Hex(), err)
+				}
+			}
+		}
+		next(w, r)
+	})
+}
+
+// loadUser looks up the user within the system and makes them available
+// through GetUser, returning dal.ErrNotFound if there is no such user
+func loadUser(r *http.Request, systemID, id dal.ObjectID) error {
+	db := web.GetDb(r)
+	if db == nil {
+		return web.ErrNoDatabase
+	}
+	user, err := models.GetUserByID(db, &systemID, &id)
+	if err != nil {
+		return err
+	}
+	SetUser(r, &user)
+	return nil
+}
+
+// RequireUser is middleware which only lets requests with a user through.
+// Browsers are redirected to loginURL, with the page they asked for in the
+// next parameter, and API clients receive a 401 response.
+func RequireUser(loginURL string) web.Middleware {
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		if GetUser(r) != nil {
+			next(w, r)
+			return
+		}
+		if !wantsHTML(r) {
+			respond(w, r, http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Redirect(w, r, loginURL, http.StatusSeeOther)
+			return
+		}
+		target, err := url.Parse(loginURL)
+		if err != nil {
+			log.Printf("Invalid login URL %q: %v", loginURL, err)
+			http.Redirect(w, r, loginURL, http.StatusFound)
+			return
+		}
+		q := target.Query()
+		q.Set("next", r.URL.RequestURI())
+		target.RawQuery = q.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	})
+}
+
+// wantsHTML reports whether the request comes from a browser rather than an
+// API client
+func wantsHTML(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// respond writes an error response with the status, as JSON through the
+// renderer when there is one
+func respond(w http.ResponseWriter, r *http.Request, status int) {
+	if renderer := web.GetRenderer(r); renderer != nil {
+		renderer.JSON(w, status, map[string]string{"error": http.StatusText(status)})
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,83 @@
+package security_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/webtest"
+)
+
+// authServer authenticates requests from the session, with handlers added
+// to the router it returns
+func authServer(t *testing.T, conn dal.Connection) (http.Handler, web.Router) {
+	store, err := web.NewStore(web.StoreOptions{
+		Type:     web.StoreMemory,
+		KeyPairs: [][]byte{[]byte(strings.Repeat("h", 32))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := web.NewRouter()
+	s := web.NewServer()
+	s.Use(web.Sessions("sid", store))
+	s.Use(web.Database(conn, "app"))
+	s.Use(security.Authenticate(testSystemID))
+	s.UseHandler(r)
+	return s, r
+}
+
+func withCookies(r *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	conn := webtest.NewConnection()
+	user := saveUser(t, conn.DB("app"), "ann@example.com")
+	s, r := authServer(t, conn)
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		web.SessionLogin(r, user.ID)
+	})
+	requireUser := security.RequireUser("/login?from=app")
+	r.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		requireUser.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(security.GetUser(r).Email))
+		})
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	cookies := w.Result().Cookies()
+	me := func(accept string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := withCookies(httptest.NewRequest("GET", "/me?a=b", nil), cookies)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := me("", cookies); w.Body.String() != "ann@example.com" {
+		t.Errorf("logged in user got %d %q", w.Code, w.Body)
+	}
+	if w := me("application/json", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("API client without a user got %d", w.Code)
+	}
+	w = me("text/html", nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login?from=app&next=%2Fme%3Fa%3Db" {
+		t.Errorf("browser without a user got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// a user removed since logging in is no longer authenticated
+	db := conn.DB("app")
+	db.C("users").RemoveAll(dal.Q{})
+	if w := me("application/json", cookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("removed user got %d", w.Code)
+	}
+}
@@ -7,18 +7,13 @@ import (
 	"github.com/goincremental/web/security/models"
 )
 
-type securityContextKey int
-
-const userKey securityContextKey = 0
+var userKey = web.NewKey[*models.User]("user")
 
 func SetUser(r *http.Request, val *models.User) {
-	web.SetContext(r, userKey, val)
+	userKey.Set(r, val)
 }
 
 func GetUser(r *http.Request) *models.User {
-	if u := web.GetContext(r, userKey); u != nil {
-		user := u.(*models.User)
-		return user
-	}
-	return nil
+	user, _ := userKey.Get(r)
+	return user
 }
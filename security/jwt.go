@@ -0,0 +1,393 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenKey is a key which signs or verifies tokens.  Keys with only a
+// public key can verify tokens but not sign them.
+type TokenKey struct {
+	// ID is sent as the kid of tokens, so the key can be found to verify them
+	ID string
+	// Method is HS256, RS256 or ES256
+	Method string
+	// Secret is the key of HS256
+	Secret []byte
+	// Private signs and Public verifies RS256 and ES256 tokens
+	Private interface{}
+	Public  interface{}
+}
+
+// HS256Key creates a TokenKey signing with HMAC SHA-256
+func HS256Key(id string, secret []byte) TokenKey {
+	return TokenKey{ID: id, Method: "HS256", Secret: secret}
+}
+
+// RS256Key creates a TokenKey signing with RSA SHA-256
+func RS256Key(id string, key *rsa.PrivateKey) TokenKey {
+	return TokenKey{ID: id, Method: "RS256", Private: key, Public: &key.PublicKey}
+}
+
+// ES256Key creates a TokenKey signing with ECDSA P-256 SHA-256
+func ES256Key(id string, key *ecdsa.PrivateKey) TokenKey {
+	return TokenKey{ID: id, Method: "ES256", Private: key, Public: &key.PublicKey}
+}
+
+func (k TokenKey) signingKey() interface{} {
+	if k.Method == "HS256" {
+		return k.Secret
+	}
+	return k.Private
+}
+
+func (k TokenKey) verifyingKey() interface{} {
+	if k.Method == "HS256" {
+		return k.Secret
+	}
+	return k.Public
+}
+
+// TokenClaims are the claims of the access tokens issued by Tokens
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	SystemID string   `json:"sys"`
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+// TokenPair is the response to issuing or refreshing tokens
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// TokenOptions configures Tokens
+type TokenOptions struct {
+	// SystemID is the system the users belong to
+	SystemID dal.ObjectID
+	// Keys sign and verify tokens.  The first key signs, and tokens signed by
+	// any of them verify, so keys are rotated by adding a new key first and
+	// removing the old key once its tokens have expired.
+	Keys []TokenKey
+	// Issuer and Audience are set on tokens and checked when verifying them
+	Issuer   string
+	Audience string
+	// AccessTTL and RefreshTTL are how long the tokens last, by default
+	// fifteen minutes and thirty days
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	// ClaimsOnly makes the user of a request from the claims of its token
+	// rather than loading them from the database, which saves a query but
+	// gives a user that cannot be saved and that keeps its roles until the
+	// token expires
+	ClaimsOnly bool
+}
+
+// ErrInvalidRefreshToken is returned when a refresh token is unknown,
+// expired or has already been used
+var ErrInvalidRefreshToken = errors.New("Invalid or expired refresh token")
+
+// Tokens issues signed JWT access tokens with refresh tokens kept in the
+// database, and is middleware authenticating requests with a bearer access
+// token.  Requests with an invalid token receive a 401 response, and those
+// without one are passed on unchanged.
+type Tokens interface {
+	web.Middleware
+	// Issue creates tokens for the user
+	Issue(r *http.Request, user *models.User) (*TokenPair, error)
+	// Verify checks an access token and returns its claims
+	Verify(token string) (*TokenClaims, error)
+	// Refresh exchanges a refresh token, which can only be used once, for
+	// new tokens
+	Refresh(r *http.Request, refreshToken string) (*TokenPair, error)
+	// Revoke removes a refresh token so it can no longer be used
+	Revoke(r *http.Request, refreshToken string) error
+	// RefreshHandler handles a form or JSON body with a refresh_token
+	RefreshHandler() http.HandlerFunc
+}
+
+type tokens struct {
+	opts TokenOptions
+	keys map[string]TokenKey
+}
+
+// refreshTokenCollection holds the refresh tokens, keyed by their hash
+const refreshTokenCollection = "refreshTokens"
+
+type refreshToken struct {
+	Hash     string       `bson:"_id"`
+	UserID   dal.ObjectID `bson:"userId"`
+	SystemID dal.ObjectID `bson:"systemId"`
+	Created  time.Time    `bson:"created"`
+	Expires  time.Time    `bson:"expires"`
+}
+
+// NewTokens creates Tokens
+func NewTokens(opts TokenOptions) (Tokens, error) {
+	if len(opts.Keys) == 0 {
+		return nil, fmt.Errorf("Tokens need at least one key")
+	}
+	if opts.AccessTTL == 0 {
+		opts.AccessTTL = 15 * time.Minute
+	}
+	if opts.RefreshTTL == 0 {
+		opts.RefreshTTL = 30 * 24 * time.Hour
+	}
+	t := &tokens{opts: opts, keys: map[string]TokenKey{}}
+	for i, k := range opts.Keys {
+		if jwt.GetSigningMethod(k.Method) == nil {
+			return nil, fmt.Errorf("Unsupported signing method %q for key %q", k.Method, k.ID)
+		}
+		if k.verifyingKey() == nil || (len(k.Secret) == 0 && k.Method == "HS256") {
+			return nil, fmt.Errorf("Key %q has nothing to verify with", k.ID)
+		}
+		if _, ok := t.keys[k.ID]; ok {
+			return nil, fmt.Errorf("Key ID %q is used more than once", k.ID)
+		}
+		if i == 0 && k.signingKey() == nil {
+			return nil, fmt.Errorf("The first key %q cannot sign", k.ID)
+		}
+		t.keys[k.ID] = k
+	}
+	return t, nil
+}
+
+func (t *tokens) Issue(r *http.Request, user *models.User) (*TokenPair, error) {
+	now := time.Now()
+	key := t.opts.Keys[0]
+	claims := TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.Hex(),
+			Issuer:    t.opts.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.opts.AccessTTL)),
+		},
+		SystemID: user.SystemID.Hex(),
+		Email:    user.Email,
+		Roles:    user.Roles,
+	}
+	if t.opts.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{t.opts.Audience}
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Method), claims)
+	token.Header["kid"] = key.ID
+	access, err := token.SignedString(key.signingKey())
+	if err != nil {
+		return nil, err
+	}
+
+	db := web.GetDb(r)
+	if db == nil {
+		return nil, web.ErrNoDatabase
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	refresh := "rt_" + base64.RawURLEncoding.EncodeToString(secret)
+	err = (*db).C(refreshTokenCollection).Insert(refreshToken{
+		Hash:     models.HashAPIKey(refresh),
+		UserID:   user.ID,
+		SystemID: user.SystemID,
+		Created:  now,
+		Expires:  now.Add(t.opts.RefreshTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(t.opts.AccessTTL / time.Second),
+	}, nil
+}
+
+func (t *tokens) Verify(token string) (*TokenClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if t.opts.Issuer != "" {
+		options = append(options, jwt.WithIssuer(t.opts.Issuer))
+	}
+	if t.opts.Audience != "" {
+		options = append(options, jwt.WithAudience(t.opts.Audience))
+	}
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := t.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown key %q", kid)
+		}
+		// the algorithm must be the key's, so a public key cannot be used
+		// as an HMAC secret
+		if token.Method.Alg() != key.Method {
+			return nil, fmt.Errorf("Key %q does not use %s", kid, token.Method.Alg())
+		}
+		return key.verifyingKey(), nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SystemID != t.opts.SystemID.Hex() || !dal.IsObjectIDHex(claims.Subject) {
+		return nil, fmt.Errorf("Token is not for this system")
+	}
+	return claims, nil
+}
+
+func (t *tokens) Refresh(r *http.Request, refresh string) (*TokenPair, error) {
+	db := web.GetDb(r)
+	if db == nil {
+		return nil, web.ErrNoDatabase
+	}
+	col := (*db).C(refreshTokenCollection)
+	hash := models.HashAPIKey(refresh)
+	var stored refreshToken
+	err := col.FindID(hash).One(&stored)
+	if errors.Is(err, dal.ErrNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the token is removed before it is checked so it is used only once
+	if err := col.RemoveID(hash); err != nil {
+		if errors.Is(err, dal.ErrNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	if time.Now().After(stored.Expires) || stored.SystemID != t.opts.SystemID {
+		return nil, ErrInvalidRefreshToken
+	}
+	// the user is loaded again so that their roles are up to date
+	user, err := models.GetUserByID(db, &t.opts.SystemID, &stored.UserID)
+	if errors.Is(err, dal.ErrNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.Issue(r, &user)
+}
+
+func (t *tokens) Revoke(r *http.Request, refresh string) error {
+	db := web.GetDb(r)
+	if db == nil {
+		return web.ErrNoDatabase
+	}
+	err := (*db).C(refreshTokenCollection).RemoveID(models.HashAPIKey(refresh))
+	if errors.Is(err, dal.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// RevokeRefreshTokens removes every refresh token of the user, so that
+// clients holding them must log in again, as when their password is reset
+func RevokeRefreshTokens(db *dal.Database, userID dal.ObjectID) error {
+	_, err := (*db).C(refreshTokenCollection).RemoveAll(dal.Q{"userId": userID})
+	return err
+}
+
+func (t *tokens) ServeHTTP(w http.ResponseWriter, r *http.Request,
+	next http.HandlerFunc) {
+	token := bearerJWT(r)
+	if token == "" {
+		next(w, r)
+		return
+	}
+	claims, err := t.Verify(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		respond(w, r, http.StatusUnauthorized)
+		return
+	}
+	id := dal.ObjectIDHex(claims.Subject)
+	if t.opts.ClaimsOnly {
+		SetUser(r, models.ClaimsUser(id, t.opts.SystemID, claims.Email, claims.Roles))
+		next(w, r)
+		return
+	}
+	// only a token of a removed user is refused, as clients throw tokens
+	// away when they are refused
+	switch err := loadUser(r, t.opts.SystemID, id); {
+	case errors.Is(err, dal.ErrNotFound):
+		respond(w, r, http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("Unable to authenticate user %s: %v", id.Hex(), err)
+		respond(w, r, http.StatusInternalServerError)
+		return
+	}
+	next(w, r)
+}
+
+// bearerJWT returns the bearer token on the request if it looks like a JWT
+func bearerJWT(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(auth[7:])
+	if strings.Count(token, ".") != 2 || models.IsAPIKey(token) {
+		return ""
+	}
+	return token
+}
+
+func (t *tokens) RefreshHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			respond(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				respond(w, r, http.StatusBadRequest)
+				return
+			}
+		} else {
+			body.RefreshToken = r.PostFormValue("refresh_token")
+		}
+		pair, err := t.Refresh(r, body.RefreshToken)
+		switch {
+		case errors.Is(err, ErrInvalidRefreshToken):
+			respond(w, r, http.StatusUnauthorized)
+			return
+		case err != nil:
+			log.Printf("Unable to refresh token: %v", err)
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if renderer := web.GetRenderer(r); renderer != nil {
+			renderer.JSON(w, http.StatusOK, pair)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pair)
+	}
+}
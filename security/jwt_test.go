@@ -0,0 +1,248 @@
+package security_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+var testHS256Secret = []byte(strings.Repeat("s", 32))
+
+// tokenServer serves /issue, which issues tokens for the user, /refresh and
+// /me, which writes the email and roles of the user of the request
+func tokenServer(t *testing.T, conn dal.Connection, tokens security.Tokens, user *models.User) (http.Handler, func() *security.TokenPair) {
+	var pair *security.TokenPair
+	r := web.NewRouter()
+	r.HandleFunc("/issue", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if pair, err = tokens.Issue(r, user); err != nil {
+			t.Error(err)
+		}
+	})
+	r.HandleFunc("/refresh", tokens.RefreshHandler())
+	r.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		if u := security.GetUser(r); u != nil {
+			w.Write([]byte(u.Email + ":" + strings.Join(u.Roles, ",")))
+		}
+	})
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.Use(tokens)
+	s.UseHandler(r)
+	issue := func() *security.TokenPair {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/issue", nil))
+		return pair
+	}
+	return s, issue
+}
+
+func bearer(h http.Handler, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestTokens(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	for _, key := range []security.TokenKey{
+		security.HS256Key("h", testHS256Secret),
+		security.RS256Key("r", rsaKey),
+		security.ES256Key("e", ecKey),
+	} {
+		t.Run(key.Method, func(t *testing.T) {
+			conn := webtest.NewConnection()
+			db := conn.DB("app")
+			user := saveUser(t, db, "ann@example.com")
+			opts := security.TokenOptions{
+				SystemID: testSystemID,
+				Keys:     []security.TokenKey{key},
+				Issuer:   "example.com",
+				Audience: "app",
+			}
+			tokens, err := security.NewTokens(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, issue := tokenServer(t, conn, tokens, user)
+			pair := issue()
+
+			if w := bearer(s, "/me", pair.AccessToken); w.Body.String() != "ann@example.com:" {
+				t.Errorf("access token got %d %q", w.Code, w.Body)
+			}
+			if w := bearer(s, "/me", pair.AccessToken+"x"); w.Code != http.StatusUnauthorized {
+				t.Errorf("tampered token got %d", w.Code)
+			}
+
+			refresh := func(token string) int {
+				w := postForm(s, "/refresh", url.Values{"refresh_token": {token}})
+				return w.Code
+			}
+			if code := refresh(pair.RefreshToken); code != http.StatusOK {
+				t.Errorf("refresh got %d", code)
+			}
+			if code := refresh(pair.RefreshToken); code != http.StatusUnauthorized {
+				t.Errorf("reused refresh token got %d", code)
+			}
+
+			opts.Audience = "other"
+			other, _ := security.NewTokens(opts)
+			if _, err := other.Verify(pair.AccessToken); err == nil {
+				t.Error("token verified for another audience")
+			}
+		})
+	}
+}
+
+func TestTokensLoadUser(t *testing.T) {
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user := saveUser(t, db, "ann@example.com")
+	tokens, _ := security.NewTokens(security.TokenOptions{
+		SystemID: testSystemID,
+		Keys:     []security.TokenKey{security.HS256Key("h", testHS256Secret)},
+	})
+	s, issue := tokenServer(t, conn, tokens, user)
+	pair := issue()
+
+	// changes to the user apply before the token expires
+	user.Roles = []string{"editor"}
+	user.Save(&db)
+	if w := bearer(s, "/me", pair.AccessToken); w.Body.String() != "ann@example.com:editor" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	db.C("users").RemoveAll(dal.Q{})
+	if w := bearer(s, "/me", pair.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of a removed user got %d", w.Code)
+	}
+}
+
+// unreachable is a database which cannot be read
+type unreachable struct{ dal.Database }
+
+func (d unreachable) C(name string) dal.Collection { return unreachableCollection{d.Database.C(name)} }
+
+type unreachableCollection struct{ dal.Collection }
+
+func (c unreachableCollection) Find(q dal.Q) dal.Query { return unreachableQuery{c.Collection.Find(q)} }
+
+type unreachableQuery struct{ dal.Query }
+
+func (q unreachableQuery) One(result interface{}) error {
+	return errors.New("no reachable servers")
+}
+
+// A valid token is not refused when the user cannot be loaded, as clients
+// throw refused tokens away
+func TestTokensDatabaseError(t *testing.T) {
+	db := webtest.NewDatabase()
+	user := saveUser(t, db, "ann@example.com")
+	tokens, _ := security.NewTokens(security.TokenOptions{
+		SystemID: testSystemID,
+		Keys:     []security.TokenKey{security.HS256Key("h", testHS256Secret)},
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	web.SetDb(req, db)
+	pair, err := tokens.Issue(req, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := web.NewServer()
+	s.Use(web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		web.SetDb(r, unreachable{db})
+		next(w, r)
+	}))
+	s.Use(tokens)
+	s.UseHandler(http.NotFoundHandler())
+	if w := bearer(s, "/", pair.AccessToken); w.Code != http.StatusInternalServerError {
+		t.Errorf("token got %d while the database is unreachable", w.Code)
+	}
+}
+
+// Users made from claims must not overwrite the stored user when saved
+func TestTokensClaimsOnly(t *testing.T) {
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user := saveUser(t, db, "ann@example.com")
+	user.SetPassword("password")
+	user.Save(&db)
+	tokens, _ := security.NewTokens(security.TokenOptions{
+		SystemID:   testSystemID,
+		Keys:       []security.TokenKey{security.HS256Key("h", testHS256Secret)},
+		ClaimsOnly: true,
+	})
+
+	var claimed *models.User
+	r := web.NewRouter()
+	r.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		claimed = security.GetUser(r)
+	})
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.Use(tokens)
+	s.UseHandler(r)
+	req := httptest.NewRequest("GET", "/", nil)
+	web.SetDb(req, db)
+	pair, err := tokens.Issue(req, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bearer(s, "/me", pair.AccessToken)
+
+	if claimed == nil || !claimed.ClaimsOnly() || claimed.Email != "ann@example.com" {
+		t.Fatalf("user %+v", claimed)
+	}
+	if err := claimed.Save(&db); err == nil {
+		t.Error("user made from claims saved")
+	}
+	got, _ := models.GetUserByEmail(&db, &testSystemID, "ann@example.com")
+	if !got.CheckPassword("password") || got.FirstName != "Ann" {
+		t.Errorf("stored user overwritten: %+v", got)
+	}
+	if got.ClaimsOnly() {
+		t.Error("loaded user is claims only")
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	oldKey := security.HS256Key("old", testHS256Secret)
+	newKey := security.HS256Key("new", []byte(strings.Repeat("n", 32)))
+	tokensWith := func(keys ...security.TokenKey) security.Tokens {
+		tokens, err := security.NewTokens(security.TokenOptions{SystemID: testSystemID, Keys: keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+	db := webtest.NewDatabase()
+	user := saveUser(t, db, "ann@example.com")
+	req := httptest.NewRequest("GET", "/", nil)
+	web.SetDb(req, db)
+	pair, err := tokensWith(oldKey).Issue(req, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tokensWith(newKey, oldKey).Verify(pair.AccessToken); err != nil {
+		t.Errorf("token of the old key rejected while rotating: %v", err)
+	}
+	if _, err := tokensWith(newKey).Verify(pair.AccessToken); err == nil {
+		t.Error("token of a removed key verified")
+	}
+}
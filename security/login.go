@@ -0,0 +1,185 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// LoginOptions configures LoginHandler
+type LoginOptions struct {
+	// SystemID is the system users log in to
+	SystemID dal.ObjectID
+	// Template is rendered for GET requests, and again with an error when
+	// the email or password is wrong.  It is bound to a map holding Request,
+	// Email, Next and Error.
+	Template string
+	// SuccessURL is where users are sent after logging in when the login
+	// page was not given a next parameter.  It defaults to /.
+	SuccessURL string
+}
+
+// ErrInvalidLogin is the error shown when the email or password is wrong
+var ErrInvalidLogin = errors.New("Invalid email or password")
+
+// dummyHash is checked against when there is no user with the email, so that
+// failed logins take as long whether or not the user exists
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+func checkDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = models.HashPassword("password")
+	})
+	models.VerifyPassword(dummyHash, password)
+}
+
+// LoginHandler handles a login form with email and password fields, or a
+// JSON body with email and password properties.  When they match a user in
+// the system the session is logged in with web.SessionLogin, which
+// regenerates it, and the user's password hash is upgraded if the
+// PasswordHashing parameters have changed.  It needs the Sessions, Database
+// and Renderer middleware to run first.
+func LoginHandler(opts LoginOptions) http.HandlerFunc {
+	if opts.SuccessURL == "" {
+		opts.SuccessURL = "/"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		api := !wantsHTML(r)
+		next := localURL(r.FormValue("next"))
+		if r.Method != "POST" {
+			renderLogin(w, r, opts, http.StatusOK, "", next, nil)
+			return
+		}
+
+		var credentials struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+				respond(w, r, http.StatusBadRequest)
+				return
+			}
+		} else {
+			credentials.Email = r.PostFormValue("email")
+			credentials.Password = r.PostFormValue("password")
+		}
+		email := strings.TrimSpace(credentials.Email)
+
+		user, err := authenticatePassword(r, opts.SystemID, email, credentials.Password)
+		switch {
+		case errors.Is(err, ErrInvalidLogin) && api:
+			respond(w, r, http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrInvalidLogin):
+			renderLogin(w, r, opts, http.StatusUnauthorized, email, next, err)
+			return
+		case err != nil:
+			log.Printf("Unable to log in %s: %v", email, err)
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if err := web.SessionLogin(r, user.ID); err != nil {
+			log.Printf("Unable to log in %s: %v", email, err)
+			respond(w, r, http.StatusInternalServerError)
+			return
+		}
+		SetUser(r, user)
+
+		if api {
+			body := map[string]string{"id": user.ID.Hex()}
+			if renderer := web.GetRenderer(r); renderer != nil {
+				renderer.JSON(w, http.StatusOK, body)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(body)
+			return
+		}
+		if next == "" {
+			next = opts.SuccessURL
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+// authenticatePassword finds the user with the email and checks their
+// password, returning ErrInvalidLogin if either is wrong
+func authenticatePassword(r *http.Request, systemID dal.ObjectID,
+	email, password string) (*models.User, error) {
+	db := web.GetDb(r)
+	if db == nil {
+		return nil, web.ErrNoDatabase
+	}
+	user, err := models.GetUserByEmail(db, &systemID, email)
+	if errors.Is(err, dal.ErrNotFound) {
+		checkDummyPassword(password)
+		return nil, ErrInvalidLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.CheckPassword(password) {
+		return nil, ErrInvalidLogin
+	}
+	if models.PasswordNeedsRehash(user.Password) {
+		if err := user.SetPassword(password); err == nil {
+			err = user.Save(db)
+		}
+		if err != nil {
+			// the user can still log in with the old hash
+			log.Printf("Unable to upgrade password hash for %s: %v", email, err)
+		}
+	}
+	return &user, nil
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, opts LoginOptions,
+	status int, email, next string, err error) {
+	renderer := web.GetRenderer(r)
+	if renderer == nil || opts.Template == "" {
+		respond(w, r, status)
+		return
+	}
+	binding := map[string]interface{}{
+		"Request": r,
+		"Email":   email,
+		"Next":    next,
+	}
+	if err != nil {
+		binding["Error"] = err.Error()
+	}
+	renderer.HTML(w, status, opts.Template, binding)
+}
+
+// localURL returns the URL if it is a path on this site, so that the next
+// parameter cannot redirect users to another site
+func localURL(u string) string {
+	if !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") ||
+		strings.HasPrefix(u, "/\\") {
+		return ""
+	}
+	return u
+}
+
+// LogoutHandler logs the session out with web.SessionLogout and redirects
+// to the URL
+func LogoutHandler(redirect string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := web.SessionLogout(r); err != nil {
+			log.Printf("Unable to log out: %v", err)
+		}
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,84 @@
+package security_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+func TestLogin(t *testing.T) {
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user := saveUser(t, db, "ann@example.com")
+	user.SetPassword("secret")
+	user.Save(&db)
+
+	s, r := authServer(t, conn)
+	r.HandleFunc("/login", security.LoginHandler(security.LoginOptions{SystemID: testSystemID}))
+	r.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		if u := security.GetUser(r); u != nil {
+			w.Write([]byte(u.Email))
+		}
+	})
+	login := func(email, password, next string) *httptest.ResponseRecorder {
+		form := url.Values{"email": {email}, "password": {password}}
+		r := httptest.NewRequest("POST", "/login?next="+url.QueryEscape(next), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := login("ann@example.com", "wrong", "/me"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password got %d", w.Code)
+	}
+	if w := login("nobody@example.com", "secret", "/me"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown email got %d", w.Code)
+	}
+	if w := login("ann@example.com", "secret", "//evil.example.com"); w.Header().Get("Location") != "/" {
+		t.Errorf("redirected to %q", w.Header().Get("Location"))
+	}
+
+	w := login(" Ann@Example.com ", "secret", "/me")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/me" {
+		t.Fatalf("login got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	me := httptest.NewRecorder()
+	s.ServeHTTP(me, withCookies(httptest.NewRequest("GET", "/me", nil), w.Result().Cookies()))
+	if me.Body.String() != "ann@example.com" {
+		t.Errorf("logged in user %q", me.Body)
+	}
+}
+
+// Logging in upgrades a password hashed with parameters no longer used
+func TestLoginRehashesPassword(t *testing.T) {
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user := saveUser(t, db, "ann@example.com")
+	user.SetPassword("secret")
+	user.Save(&db)
+
+	saved := models.PasswordHashing
+	defer func() { models.PasswordHashing = saved }()
+	models.PasswordHashing.Algorithm = models.Argon2id
+	models.PasswordHashing.Memory = 1024
+
+	s, r := authServer(t, conn)
+	r.HandleFunc("/login", security.LoginHandler(security.LoginOptions{SystemID: testSystemID}))
+	w := postForm(s, "/login", url.Values{"email": {"ann@example.com"}, "password": {"secret"}})
+	if w.Code != http.StatusOK || w.Body.String() != `{"id":"`+user.ID.Hex()+`"}`+"\n" {
+		t.Fatalf("login got %d %q", w.Code, w.Body)
+	}
+	got, _ := models.GetUserByEmail(&db, &testSystemID, "ann@example.com")
+	if !strings.HasPrefix(got.Password, "$argon2id$") || !got.CheckPassword("secret") ||
+		models.PasswordNeedsRehash(got.Password) {
+		t.Errorf("password hash %q", got.Password)
+	}
+}
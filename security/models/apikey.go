@@ -0,0 +1,172 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/goincremental/dal"
+)
+
+// AllScopes is the scope granting every scope, which keys migrated from an
+// APISecret are given so that existing clients keep working
+const AllScopes = "*"
+
+// apiKeyPrefix starts every API key, so that keys can be told apart from
+// other bearer tokens
+const apiKeyPrefix = "ak_"
+
+// APIKey is one of a user's API keys.  Only a hash of the key is kept, so
+// the key itself is shown to the user once, when it is created.
+type APIKey struct {
+	// ID identifies the key to the user without revealing it
+	ID      string    `bson:"id"`
+	Name    string    `bson:"name"`
+	Hash    string    `bson:"hash"`
+	Scopes  []string  `bson:"scopes"`
+	Created time.Time `bson:"created"`
+	// Expires is when the key stops working, or zero if it never does
+	Expires time.Time `bson:"expires"`
+	// Sealed is the key encrypted by the server, for keys allowed to sign
+	// requests, as a signature cannot be checked with the hash alone
+	Sealed string `bson:"sealed,omitempty"`
+}
+
+// Expired reports whether the key has expired
+func (k *APIKey) Expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// HasScope reports whether the key was granted the scope, or AllScopes
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == AllScopes {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns the hash kept for an API key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyID returns the ID of the key, which is part of the key for keys
+// made by AddAPIKey, and derived from its hash for migrated API secrets
+func APIKeyID(key string) string {
+	if rest, ok := strings.CutPrefix(key, apiKeyPrefix); ok {
+		if id, _, ok := strings.Cut(rest, "_"); ok {
+			return id
+		}
+	}
+	return HashAPIKey(key)[:12]
+}
+
+// IsAPIKey reports whether the string has the form of an API key
+func IsAPIKey(s string) bool {
+	return strings.HasPrefix(s, apiKeyPrefix)
+}
+
+// AddAPIKey creates a named API key with the scopes, which expires at the
+// given time unless it is zero.  It returns the key, which is not kept, and
+// the user must be saved for the key to work.
+func (u *User) AddAPIKey(name string, scopes []string,
+	expires time.Time) (string, *APIKey, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	k := APIKey{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+		Expires: expires,
+	}
+	key := apiKeyPrefix + k.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = HashAPIKey(key)
+	u.APIKeys = append(u.APIKeys, k)
+	return key, &u.APIKeys[len(u.APIKeys)-1], nil
+}
+
+// RemoveAPIKey removes the API key with the id, reporting whether the user
+// had it.  The user must be saved for the key to stop working.
+func (u *User) RemoveAPIKey(id string) bool {
+	for i, k := range u.APIKeys {
+		if k.ID == id {
+			u.APIKeys = append(u.APIKeys[:i:i], u.APIKeys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// MigrateAPISecret replaces the plain text APISecret of the user with an
+// API key holding its hash, so existing clients keep working.  The key has
+// AllScopes, as the secret could do anything before, and never expires.
+// The user must be saved afterwards.
+func (u *User) MigrateAPISecret(name string) {
+	if u.APISecret == "" {
+		return
+	}
+	u.APIKeys = append(u.APIKeys, APIKey{
+		ID:      APIKeyID(u.APISecret),
+		Name:    name,
+		Hash:    HashAPIKey(u.APISecret),
+		Scopes:  []string{AllScopes},
+		Created: time.Now(),
+	})
+	u.APISecret = ""
+}
+
+// GetUserByAPIKeyID allows a user to be found by the ID of one of their API
+// keys within a system.  It returns the key, which may have expired.
+func GetUserByAPIKeyID(db *dal.Database, systemID *dal.ObjectID,
+	id string) (result User, apiKey *APIKey, err error) {
+	users := (*db).C(userCollection)
+
+	err = users.Find(dal.Q{
+		"systemId":   systemID,
+		"apiKeys.id": id},
+	).One(&result)
+	if err != nil {
+		return
+	}
+	for i := range result.APIKeys {
+		if result.APIKeys[i].ID == id {
+			apiKey = &result.APIKeys[i]
+		}
+	}
+	return
+}
+
+// GetUserByAPIKey allows a user to be found by one of their API keys within
+// a system.  It returns the key, which may have expired.
+func GetUserByAPIKey(db *dal.Database, systemID *dal.ObjectID,
+	key string) (result User, apiKey *APIKey, err error) {
+	users := (*db).C(userCollection)
+	hash := HashAPIKey(key)
+
+	err = users.Find(dal.Q{
+		"systemId":     systemID,
+		"apiKeys.hash": hash},
+	).One(&result)
+	if err != nil {
+		return
+	}
+	for i := range result.APIKeys {
+		if result.APIKeys[i].Hash == hash {
+			apiKey = &result.APIKeys[i]
+		}
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// PasswordParams configures how passwords are hashed.  Passwords hashed with
+// other parameters still verify, and report that they need rehashing so
+// they can be upgraded when the user next logs in.
+type PasswordParams struct {
+	Algorithm string
+	// BcryptCost is the cost used by bcrypt
+	BcryptCost int
+	// Memory in KiB, Iterations and Parallelism are used by argon2id
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// PasswordHashing holds the parameters used to hash new passwords
+var PasswordHashing = PasswordParams{
+	Algorithm:   Argon2id,
+	BcryptCost:  bcrypt.DefaultCost,
+	Memory:      64 * 1024,
+	Iterations:  1,
+	Parallelism: 4,
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	// argon2MinLen is the shortest salt or key accepted in a hash, as a hash
+	// with an empty key would match any password
+	argon2MinLen = 8
+)
+
+// argon2Hash is an argon2id hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=1,p=4$salt$key
+type argon2Hash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func parseArgon2Hash(s string) (*argon2Hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return nil, fmt.Errorf("Invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("Unsupported argon2id version %q", parts[2])
+	}
+	h := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&h.memory, &h.iterations, &h.parallelism); err != nil {
+		return nil, fmt.Errorf("Invalid argon2id parameters: %v", err)
+	}
+	if h.memory == 0 || h.iterations == 0 || h.parallelism == 0 {
+		return nil, fmt.Errorf("Invalid argon2id parameters %q", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("Invalid argon2id salt: %v", err)
+	}
+	if len(h.salt) < argon2MinLen {
+		return nil, fmt.Errorf("Invalid argon2id salt of %d bytes", len(h.salt))
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("Invalid argon2id key: %v", err)
+	}
+	if len(h.key) < argon2MinLen {
+		return nil, fmt.Errorf("Invalid argon2id key of %d bytes", len(h.key))
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) String() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+		h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(h.salt),
+		base64.RawStdEncoding.EncodeToString(h.key))
+}
+
+// HashPassword hashes the password with the PasswordHashing parameters
+func HashPassword(password string) (string, error) {
+	p := PasswordHashing
+	switch p.Algorithm {
+	case Bcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		return string(b), err
+	case Argon2id:
+		h := &argon2Hash{
+			memory:      p.Memory,
+			iterations:  p.Iterations,
+			parallelism: p.Parallelism,
+			salt:        make([]byte, argon2SaltLen),
+		}
+		if _, err := rand.Read(h.salt); err != nil {
+			return "", err
+		}
+		h.key = argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory,
+			h.parallelism, argon2KeyLen)
+		return h.String(), nil
+	}
+	return "", fmt.Errorf("Unknown password hashing algorithm %q", p.Algorithm)
+}
+
+// VerifyPassword reports whether the password matches the hash, which may
+// have been made by either algorithm
+func VerifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$"+Argon2id+"$") {
+		h, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory,
+			h.parallelism, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// PasswordNeedsRehash reports whether the hash was made with different
+// algorithm or parameters to the PasswordHashing ones
+func PasswordNeedsRehash(hash string) bool {
+	p := PasswordHashing
+	switch p.Algorithm {
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != p.BcryptCost
+	case Argon2id:
+		h, err := parseArgon2Hash(hash)
+		return err != nil || h.memory != p.Memory || h.iterations != p.Iterations ||
+			h.parallelism != p.Parallelism
+	}
+	return false
+}
+
+// SetPassword hashes the password and stores the hash on the user
+func (u *User) SetPassword(password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.Password = hash
+	return nil
+}
+
+// CheckPassword reports whether the password is the user's password
+func (u *User) CheckPassword(password string) bool {
+	if u.Password == "" {
+		return false
+	}
+	return VerifyPassword(u.Password, password)
+}
@@ -0,0 +1,43 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/goincremental/web/security/models"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	saved := models.PasswordHashing
+	defer func() { models.PasswordHashing = saved }()
+	models.PasswordHashing.Memory = 1024
+
+	for _, algorithm := range []string{models.Argon2id, models.Bcrypt} {
+		models.PasswordHashing.Algorithm = algorithm
+		models.PasswordHashing.BcryptCost = 4
+		hash, err := models.HashPassword("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !models.VerifyPassword(hash, "secret") || models.VerifyPassword(hash, "wrong") {
+			t.Errorf("%s hash %q", algorithm, hash)
+		}
+	}
+}
+
+// A hash with its salt or key cut short must not match every password
+func TestVerifyPasswordMalformed(t *testing.T) {
+	salt, key := "c29tZXNhbHRzb21lc2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	for name, hash := range map[string]string{
+		"empty key":     "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$",
+		"short key":     "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$a2V5",
+		"empty salt":    "$argon2id$v=19$m=1024,t=1,p=1$$" + key,
+		"no iterations": "$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key,
+		"no threads":    "$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key,
+	} {
+		for _, password := range []string{"", "secret"} {
+			if models.VerifyPassword(hash, password) {
+				t.Errorf("%s: %q matched", name, password)
+			}
+		}
+	}
+}
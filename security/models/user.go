@@ -1,6 +1,12 @@
 package models
 
-import "github.com/goincremental/dal"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goincremental/dal"
+)
 
 // OAuthID allows a user to be matched to different OAuth provider accounts
 // (i.e. google, facebook, twitter, linked in) using the id from that provider.
@@ -9,6 +15,14 @@ type OAuthID struct {
 	ID       string `bson:"providerId"`
 }
 
+//UserToken is a single use token issued to a user, such as a password
+//reset token.  Only a hash of the token is kept.
+type UserToken struct {
+	Purpose string    `bson:"purpose"`
+	Hash    string    `bson:"hash"`
+	Expires time.Time `bson:"expires"`
+}
+
 //User is a struct that represents a user of the application
 type User struct {
 	ID        dal.ObjectID `bson:"_id"`
@@ -20,6 +34,31 @@ type User struct {
 	APISecret string       `bson:"apiSecret"`
 	OAuthID   []OAuthID    `bson:"userIds"`
 	Roles     []string     `bson:"roles"`
+
+	EmailVerified bool        `bson:"emailVerified"`
+	Tokens        []UserToken `bson:"tokens,omitempty"`
+	APIKeys       []APIKey    `bson:"apiKeys,omitempty"`
+
+	claimsOnly bool
+}
+
+//ClaimsUser makes a user from the claims of a token without loading them
+//from the database.  The user only has the fields given, so it cannot be
+//saved, which would overwrite the stored user with them.
+func ClaimsUser(id, systemID dal.ObjectID, email string, roles []string) *User {
+	return &User{
+		ID:         id,
+		SystemID:   systemID,
+		Email:      email,
+		Roles:      roles,
+		claimsOnly: true,
+	}
+}
+
+//ClaimsOnly reports whether the user was made from the claims of a token
+//rather than loaded from the database
+func (u *User) ClaimsOnly() bool {
+	return u.claimsOnly
 }
 
 const userCollection string = "users"
@@ -50,8 +89,35 @@ func GetUserByID(db *dal.Database, systemID *dal.ObjectID,
 	return
 }
 
-//Save persists the user to the database through the dal
+//NormalizeEmail returns the email lowercased and without surrounding space,
+//which is how Save keeps it, so that users are found whatever the case of
+//the email they give
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+//GetUserByEmail allows a single user to be found by email within a system.
+//The email is normalized with NormalizeEmail.
+func GetUserByEmail(db *dal.Database, systemID *dal.ObjectID,
+	email string) (result User, err error) {
+	users := (*db).C(userCollection)
+
+	err = users.Find(dal.Q{
+		"systemId": systemID,
+		"email":    NormalizeEmail(email)},
+	).One(&result)
+
+	return
+}
+
+//Save persists the user to the database through the dal, normalizing
+//their email with NormalizeEmail.  Users made from token claims cannot be
+//saved.
 func (u *User) Save(db *dal.Database) (err error) {
+	if u.claimsOnly {
+		return fmt.Errorf("User %s was made from token claims and cannot be saved", u.ID.Hex())
+	}
+	u.Email = NormalizeEmail(u.Email)
 	col := (*db).C(userCollection)
 	if !u.ID.Valid() {
 		u.ID = dal.NewObjectID()
@@ -60,3 +126,14 @@ func (u *User) Save(db *dal.Database) (err error) {
 
 	return err
 }
+
+//RemoveToken removes the token with the hash from the user with a single
+//conditional update, returning dal.ErrNotFound if the user no longer has
+//it, so that a token can only be used once
+func (u *User) RemoveToken(db *dal.Database, hash string) error {
+	return (*db).C(userCollection).Update(dal.Q{
+		"_id":         u.ID,
+		"systemId":    u.SystemID,
+		"tokens.hash": hash,
+	}, dal.Q{"$pull": dal.Q{"tokens": dal.Q{"hash": hash}}})
+}
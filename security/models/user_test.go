@@ -0,0 +1,31 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+var testSystemID = dal.ObjectIDHex("5f1d7c0a9b1e8a0001a1b2d0")
+
+func TestGetUserByEmail(t *testing.T) {
+	db := webtest.NewDatabase()
+	u := &models.User{SystemID: testSystemID, Email: " Ann@Example.com"}
+	if err := u.Save(&db); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "ann@example.com" {
+		t.Errorf("saved email %q", u.Email)
+	}
+	for _, email := range []string{"ann@example.com", "ANN@example.com ", " Ann@Example.com"} {
+		if got, err := models.GetUserByEmail(&db, &testSystemID, email); err != nil || got.ID != u.ID {
+			t.Errorf("%q: %v", email, err)
+		}
+	}
+	other := dal.ObjectIDHex("5f1d7c0a9b1e8a0001a1b2d1")
+	if _, err := models.GetUserByEmail(&db, &other, "ann@example.com"); err != dal.ErrNotFound {
+		t.Errorf("found in another system: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package security
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// Policy decides whether the user may perform an action on a resource of
+// type T, for example whether they own the document they want to edit
+type Policy[T any] func(user *models.User, resource T) bool
+
+type policyKey struct {
+	resource reflect.Type
+	action   string
+}
+
+var (
+	policyMu sync.RWMutex
+	// permissions maps each action to the roles allowed to perform it on any
+	// resource
+	permissions = map[string][]string{}
+	policies    = map[policyKey]func(user *models.User, resource interface{}) bool{}
+	// interfacePolicies are the keys of policies for interface types, in the
+	// order they were registered
+	interfacePolicies []policyKey
+)
+
+var resourceKey = web.NewKey[interface{}]("resource")
+
+// GrantPermission allows users with any of the roles to perform the action
+// on any resource
+func GrantPermission(action string, roles ...string) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	permissions[action] = append(permissions[action], roles...)
+}
+
+// RegisterPolicy registers the policy deciding whether users may perform
+// the action on resources of type T.  It applies to users who have not been
+// granted the permission through their roles.  When T is an interface, the
+// policy applies to resources implementing it which have no policy of their
+// own, and the first registered applies if they implement several.
+func RegisterPolicy[T any](action string, p Policy[T]) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	key := policyKey{t, action}
+	if _, ok := policies[key]; !ok && t.Kind() == reflect.Interface {
+		interfacePolicies = append(interfacePolicies, key)
+	}
+	policies[key] = func(user *models.User, resource interface{}) bool {
+		return p(user, resource.(T))
+	}
+}
+
+// Can reports whether the user may perform the action on the resource,
+// which may be nil for actions that do not concern a resource.  Users may
+// if one of their roles has been granted the permission, or the policy for
+// the type of resource allows it.  Everything else is refused, including a
+// nil pointer to a resource.
+func Can(user *models.User, action string, resource interface{}) bool {
+	if user == nil {
+		return false
+	}
+	policyMu.RLock()
+	roles := permissions[action]
+	policyMu.RUnlock()
+	if HasAnyRole(user, roles...) {
+		return true
+	}
+	if resource == nil {
+		return false
+	}
+	if v := reflect.ValueOf(resource); v.Kind() == reflect.Ptr && v.IsNil() {
+		return false
+	}
+	p, resource := policyFor(action, resource)
+	return p != nil && p(user, resource)
+}
+
+// policyFor finds the policy for the resource, falling back to the policy
+// for the type pointed to when the resource is a pointer, and then to the
+// policies for interfaces the resource implements
+func policyFor(action string, resource interface{}) (
+	func(*models.User, interface{}) bool, interface{}) {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	v := reflect.ValueOf(resource)
+	if p, ok := policies[policyKey{v.Type(), action}]; ok {
+		return p, resource
+	}
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		if p, ok := policies[policyKey{v.Type().Elem(), action}]; ok {
+			return p, v.Elem().Interface()
+		}
+	}
+	for _, key := range interfacePolicies {
+		if key.action == action && v.Type().Implements(key.resource) {
+			return policies[key], resource
+		}
+	}
+	return nil, nil
+}
+
+// ResourceLoader loads the resource a request acts on, usually using the
+// route parameters
+type ResourceLoader func(r *http.Request) (interface{}, error)
+
+// RequirePermission is middleware which only lets through users who Can
+// perform the action on the resource loaded by load, which may be nil for
+// actions that do not concern a resource.  The resource is available to the
+// handler through Resource, so it need not be loaded again.
+func RequirePermission(action string, load ResourceLoader) web.Middleware {
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		var resource interface{}
+		if load != nil && GetUser(r) != nil {
+			var err error
+			resource, err = load(r)
+			switch {
+			case errors.Is(err, dal.ErrNotFound):
+				respond(w, r, http.StatusNotFound)
+				return
+			case err != nil:
+				log.Printf("Unable to load resource for %s: %v", r.URL.Path, err)
+				respond(w, r, http.StatusInternalServerError)
+				return
+			}
+			resourceKey.Set(r, resource)
+		}
+		allowed := authorize(w, r, func(u *models.User) bool {
+			return Can(u, action, resource)
+		})
+		if allowed {
+			next(w, r)
+		}
+	})
+}
+
+// Resource returns the resource loaded by RequirePermission
+func Resource(r *http.Request) interface{} {
+	resource, _ := resourceKey.Get(r)
+	return resource
+}
+
+// TemplateFuncs returns the template functions of the package, which are
+// registered with web.AddTemplateFuncs before the renderer is created:
+//
+//	web.AddTemplateFuncs(security.TemplateFuncs())
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"Can": templateCan,
+	}
+}
+
+// templateCan is the Can template function, which takes either the user or
+// the request, for example [[ if Can .Request "edit" .Doc ]]
+func templateCan(v interface{}, action string, resource ...interface{}) bool {
+	var user *models.User
+	switch t := v.(type) {
+	case *models.User:
+		user = t
+	case *http.Request:
+		user = GetUser(t)
+	}
+	var res interface{}
+	if len(resource) > 0 {
+		res = resource[0]
+	}
+	return Can(user, action, res)
+}
@@ -0,0 +1,119 @@
+package security_test
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+type document struct {
+	Owner dal.ObjectID
+}
+
+func (d document) OwnerID() dal.ObjectID { return d.Owner }
+
+// owned is implemented by resources with an owner
+type owned interface {
+	OwnerID() dal.ObjectID
+}
+
+type note struct {
+	Owner dal.ObjectID
+}
+
+func (n *note) OwnerID() dal.ObjectID { return n.Owner }
+
+var (
+	owner = &models.User{ID: dal.ObjectIDHex("5f1d7c0a9b1e8a0001a1b2c3")}
+	other = &models.User{ID: dal.ObjectIDHex("5f1d7c0a9b1e8a0001a1b2c4")}
+)
+
+func TestPolicy(t *testing.T) {
+	security.GrantPermission("edit", "admin")
+	security.RegisterPolicy("edit", func(u *models.User, d document) bool {
+		return d.Owner == u.ID
+	})
+	admin := &models.User{Roles: []string{"admin"}}
+	d := &document{Owner: owner.ID}
+
+	if !security.Can(owner, "edit", d) || !security.Can(owner, "edit", *d) || !security.Can(admin, "edit", d) {
+		t.Error("owner and admin cannot edit")
+	}
+	if security.Can(other, "edit", d) || security.Can(owner, "delete", d) || security.Can(nil, "edit", d) {
+		t.Error("permission granted without a policy or role")
+	}
+
+	mw := security.RequirePermission("edit", func(r *http.Request) (interface{}, error) {
+		return d, nil
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			if security.Resource(r) != d {
+				t.Error("resource not on the request")
+			}
+		})
+	})
+	webtest.NewRequest(t, "GET", "/", nil).WithUser(other).Serve(h).
+		AssertStatus(http.StatusForbidden)
+	webtest.NewRequest(t, "GET", "/", nil).WithUser(owner).Serve(h).
+		AssertStatus(http.StatusOK)
+}
+
+func TestInterfacePolicy(t *testing.T) {
+	security.RegisterPolicy("archive", func(u *models.User, o owned) bool {
+		return o.OwnerID() == u.ID
+	})
+	security.RegisterPolicy("archive", func(u *models.User, d document) bool {
+		return false
+	})
+
+	if !security.Can(owner, "archive", &note{Owner: owner.ID}) {
+		t.Error("policy for an interface not applied")
+	}
+	if security.Can(other, "archive", &note{Owner: owner.ID}) {
+		t.Error("policy for an interface allowed another user")
+	}
+	// a policy for the type itself comes first
+	if security.Can(owner, "archive", document{Owner: owner.ID}) {
+		t.Error("policy for the type not applied")
+	}
+}
+
+// Policies are not given nil resources to dereference
+func TestPolicyNilResource(t *testing.T) {
+	security.RegisterPolicy("share", func(u *models.User, n *note) bool {
+		return n.Owner == u.ID
+	})
+	security.RegisterPolicy("share", func(u *models.User, d document) bool {
+		return d.Owner == u.ID
+	})
+	for _, resource := range []interface{}{nil, (*note)(nil), (*document)(nil)} {
+		if security.Can(owner, "share", resource) {
+			t.Errorf("%T resource allowed", resource)
+		}
+	}
+}
+
+func TestPolicyTemplateFuncs(t *testing.T) {
+	security.RegisterPolicy("print", func(u *models.User, d document) bool {
+		return d.Owner == u.ID
+	})
+	web.AddTemplateFuncs(security.TemplateFuncs())
+	tpl := template.Must(template.New("t").Funcs(web.TemplateFuncs()).
+		Parse(`{{ if Can .User "print" .Doc }}yes{{ end }}`))
+
+	for user, want := range map[*models.User]string{owner: "yes", other: ""} {
+		var buf bytes.Buffer
+		tpl.Execute(&buf, map[string]interface{}{"User": user, "Doc": document{Owner: owner.ID}})
+		if buf.String() != want {
+			t.Errorf("template Can gave %q, want %q", buf.String(), want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package security
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+var (
+	rolesMu sync.RWMutex
+	// implied maps each role to every role it implies, including itself
+	implied           = map[string]map[string]bool{}
+	forbiddenTemplate string
+)
+
+// SetRoleHierarchy configures which roles imply others, for example
+// {"admin": {"editor"}, "editor": {"viewer"}} gives admins the editor and
+// viewer roles as well.  It is meant to be called once at start up.
+func SetRoleHierarchy(hierarchy map[string][]string) {
+	expanded := map[string]map[string]bool{}
+	var expand func(role string, into map[string]bool)
+	expand = func(role string, into map[string]bool) {
+		if into[role] {
+			return
+		}
+		into[role] = true
+		for _, child := range hierarchy[role] {
+			expand(child, into)
+		}
+	}
+	for role := range hierarchy {
+		expanded[role] = map[string]bool{}
+		expand(role, expanded[role])
+	}
+
+	rolesMu.Lock()
+	defer rolesMu.Unlock()
+	implied = expanded
+}
+
+// SetForbiddenTemplate sets the template rendered for browsers refused by
+// the role middleware.  Without one, refusals are rendered as JSON.  The
+// template is bound to the request and the user.
+func SetForbiddenTemplate(name string) {
+	rolesMu.Lock()
+	defer rolesMu.Unlock()
+	forbiddenTemplate = name
+}
+
+// HasRole reports whether the user has the role, either directly or
+// through the role hierarchy
+func HasRole(user *models.User, role string) bool {
+	if user == nil {
+		return false
+	}
+	rolesMu.RLock()
+	defer rolesMu.RUnlock()
+	for _, r := range user.Roles {
+		if r == role || implied[r][role] {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAnyRole reports whether the user has at least one of the roles
+func HasAnyRole(user *models.User, roles ...string) bool {
+	for _, role := range roles {
+		if HasRole(user, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRoles reports whether the user has all of the roles
+func HasRoles(user *models.User, roles ...string) bool {
+	for _, role := range roles {
+		if !HasRole(user, role) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireRoles is middleware which only lets through users with all of the
+// roles
+func RequireRoles(roles ...string) web.Middleware {
+	return requireRoles(func(u *models.User) bool {
+		return HasRoles(u, roles...)
+	})
+}
+
+// RequireAnyRole is middleware which only lets through users with at least
+// one of the roles
+func RequireAnyRole(roles ...string) web.Middleware {
+	return requireRoles(func(u *models.User) bool {
+		return HasAnyRole(u, roles...)
+	})
+}
+
+func requireRoles(allowed func(u *models.User) bool) web.Middleware {
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		if authorize(w, r, allowed) {
+			next(w, r)
+		}
+	})
+}
+
+// AuthorizeRoute is a web.RouteAuthorizer which checks the user on the
+// request has one of the roles of the route, for use with
+// Router.SetAuthorizer
+func AuthorizeRoute(w http.ResponseWriter, r *http.Request, roles []string) bool {
+	return authorize(w, r, func(u *models.User) bool {
+		return HasAnyRole(u, roles...)
+	})
+}
+
+// authorize reports whether the user on the request is allowed, responding
+// with 401 when there is no user and 403 when they are refused
+func authorize(w http.ResponseWriter, r *http.Request,
+	allowed func(u *models.User) bool) bool {
+	user := GetUser(r)
+	switch {
+	case user == nil:
+		respond(w, r, http.StatusUnauthorized)
+		return false
+	case !allowed(user):
+		forbidden(w, r, user)
+		return false
+	}
+	return true
+}
+
+// forbidden renders the 403 response, using the forbidden template for
+// browsers when one is set
+func forbidden(w http.ResponseWriter, r *http.Request, user *models.User) {
+	rolesMu.RLock()
+	template := forbiddenTemplate
+	rolesMu.RUnlock()
+
+	renderer := web.GetRenderer(r)
+	if renderer != nil && template != "" && wantsHTML(r) {
+		renderer.HTML(w, http.StatusForbidden, template, map[string]interface{}{
+			"Request": r,
+			"User":    user,
+		})
+		return
+	}
+	respond(w, r, http.StatusForbidden)
+}
@@ -0,0 +1,64 @@
+package security_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+func rolesRouter(authorizer web.RouteAuthorizer) web.Router {
+	r := web.NewRouter()
+	r.SetAuthorizer(authorizer)
+	r.HandleFunc("/edit", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}).Roles("viewer")
+	r.HandleFunc("/open", func(w http.ResponseWriter, r *http.Request) {})
+	return r
+}
+
+func TestRouteRoles(t *testing.T) {
+	security.SetRoleHierarchy(map[string][]string{
+		"admin":  {"editor"},
+		"editor": {"viewer"},
+	})
+	r := rolesRouter(security.AuthorizeRoute)
+	for _, test := range []struct {
+		roles []string
+		code  int
+	}{
+		{[]string{"admin"}, http.StatusOK},
+		{[]string{"viewer"}, http.StatusOK},
+		{[]string{"other"}, http.StatusForbidden},
+		{nil, http.StatusForbidden},
+	} {
+		user := &models.User{Roles: test.roles}
+		webtest.NewRequest(t, "GET", "/edit", nil).WithUser(user).Serve(r).
+			AssertStatus(test.code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/edit", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without a user got %d", w.Code)
+	}
+
+	if !security.HasRoles(&models.User{Roles: []string{"admin"}}, "viewer", "editor") {
+		t.Error("admin does not have the roles it implies")
+	}
+	if security.HasRole(&models.User{Roles: []string{"viewer"}}, "editor") {
+		t.Error("viewer has a role it does not imply")
+	}
+}
+
+func TestRouteRolesWithoutAuthorizer(t *testing.T) {
+	r := rolesRouter(nil)
+	admin := &models.User{Roles: []string{"admin"}}
+	webtest.NewRequest(t, "GET", "/edit", nil).WithUser(admin).Serve(r).
+		AssertStatus(http.StatusForbidden)
+	webtest.NewRequest(t, "GET", "/open", nil).Serve(r).AssertStatus(http.StatusOK)
+}
@@ -0,0 +1,355 @@
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// signatureScheme is the Authorization scheme of signed requests, which
+// carry a header like
+//
+//	Authorization: HMAC-SHA256 KeyId=..., Timestamp=..., Nonce=..., Signature=...
+//
+// The signature is an HMAC of the method, host, request URI, hex SHA-256 of
+// the body, timestamp and nonce, each on its own line, so that a request
+// cannot be replayed against another service.  It is keyed with the user's
+// API key, which the server keeps encrypted by its keyring once AllowSigning
+// is called, so reading the user records is not enough to sign requests.
+const signatureScheme = "HMAC-SHA256"
+
+// NonceCache remembers the nonces of signed requests until they expire, so
+// that requests cannot be replayed.  Servers behind a load balancer need a
+// shared cache.
+type NonceCache interface {
+	// Add records the nonce, reporting false if it has already been seen
+	Add(nonce string, expires time.Time) bool
+}
+
+type memoryNonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	swept  time.Time
+}
+
+// NewMemoryNonceCache creates a NonceCache held in memory
+func NewMemoryNonceCache() NonceCache {
+	return &memoryNonceCache{nonces: map[string]time.Time{}}
+}
+
+func (c *memoryNonceCache) Add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.swept) > time.Minute {
+		for n, e := range c.nonces {
+			if now.After(e) {
+				delete(c.nonces, n)
+			}
+		}
+		c.swept = now
+	}
+	if e, ok := c.nonces[nonce]; ok && now.Before(e) {
+		return false
+	}
+	c.nonces[nonce] = expires
+	return true
+}
+
+// SignatureOptions configures SignedRequests
+type SignatureOptions struct {
+	// SystemID is the system the users belong to
+	SystemID dal.ObjectID
+	// Keys decrypts the API keys encrypted by AllowSigning, and must be set.
+	// Keys encrypted by any of its keys are accepted, so that it can be
+	// rotated.
+	Keys web.Keyring
+	// MaxSkew is how far the timestamp of a request may be from the server's
+	// clock, by default five minutes
+	MaxSkew time.Duration
+	// Nonces records the nonces seen, by default in memory
+	Nonces NonceCache
+	// MaxBody is the largest body that will be read to check its hash, by
+	// default 10MB
+	MaxBody int64
+}
+
+var errBadSignature = errors.New("Invalid request signature")
+
+// SignedRequests is middleware which authenticates requests signed with an
+// API key, by a client using SigningTransport, and makes the key's user
+// available through GetUser.  Requests with a bad, stale or replayed
+// signature receive a 401 response, and requests which are not signed are
+// passed on unchanged.  It needs the Database middleware to run first, and
+// panics if opts has no Keys.
+func SignedRequests(opts SignatureOptions) web.Middleware {
+	if opts.Keys == nil {
+		panic("security: SignedRequests needs a Keyring to check signatures")
+	}
+	if opts.MaxSkew == 0 {
+		opts.MaxSkew = 5 * time.Minute
+	}
+	if opts.Nonces == nil {
+		opts.Nonces = NewMemoryNonceCache()
+	}
+	if opts.MaxBody == 0 {
+		opts.MaxBody = 10 << 20
+	}
+	return web.MiddlewareFunc(func(w http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, signatureScheme+" ") {
+			next(w, r)
+			return
+		}
+		user, key, err := verifySignature(r, opts, auth[len(signatureScheme)+1:])
+		if err != nil {
+			if !errors.Is(err, errBadSignature) {
+				log.Printf("Unable to check request signature: %v", err)
+				respond(w, r, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", signatureScheme)
+			respond(w, r, http.StatusUnauthorized)
+			return
+		}
+		SetUser(r, user)
+		apiKeyKey.Set(r, key)
+		next(w, r)
+	})
+}
+
+func verifySignature(r *http.Request, opts SignatureOptions,
+	params string) (*models.User, *models.APIKey, error) {
+	p := parseSignatureParams(params)
+	keyID, nonce := p["KeyId"], p["Nonce"]
+	signature, err := base64.StdEncoding.DecodeString(p["Signature"])
+	if keyID == "" || nonce == "" || err != nil {
+		return nil, nil, errBadSignature
+	}
+	timestamp, err := strconv.ParseInt(p["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, nil, errBadSignature
+	}
+	signed := time.Unix(timestamp, 0)
+	if skew := time.Since(signed); skew > opts.MaxSkew || skew < -opts.MaxSkew {
+		return nil, nil, errBadSignature
+	}
+
+	db := web.GetDb(r)
+	if db == nil {
+		return nil, nil, web.ErrNoDatabase
+	}
+	user, key, err := models.GetUserByAPIKeyID(db, &opts.SystemID, keyID)
+	if errors.Is(err, dal.ErrNotFound) {
+		return nil, nil, errBadSignature
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.Expired() || key.Sealed == "" {
+		return nil, nil, errBadSignature
+	}
+	apiKey, err := unsealAPIKey(opts.Keys, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bodyHash, err := hashBody(r, opts.MaxBody)
+	if err != nil {
+		return nil, nil, errBadSignature
+	}
+	expected := signRequest([]byte(apiKey), r.Method, r.Host, r.URL.RequestURI(),
+		bodyHash, p["Timestamp"], nonce)
+	if !hmac.Equal(signature, expected) {
+		return nil, nil, errBadSignature
+	}
+	// the nonce is only recorded once the signature is known to be genuine,
+	// so that others cannot use up nonces
+	if !opts.Nonces.Add(keyID+":"+nonce, signed.Add(opts.MaxSkew)) {
+		return nil, nil, errBadSignature
+	}
+	return &user, key, nil
+}
+
+func parseSignatureParams(s string) map[string]string {
+	params := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[name] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+// hashBody returns the hex SHA-256 of the request body, replacing the body
+// so that it can still be read by the handler
+func hashBody(r *http.Request, max int64) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return hashHex(nil), nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) > max {
+		return "", fmt.Errorf("Request body is larger than %d bytes", max)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return hashHex(b), nil
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func signRequest(secret []byte, method, host, uri, bodyHash, timestamp,
+	nonce string) []byte {
+	m := hmac.New(sha256.New, secret)
+	io.WriteString(m, strings.Join([]string{method, strings.ToLower(host), uri,
+		bodyHash, timestamp, nonce}, "\n"))
+	return m.Sum(nil)
+}
+
+// AllowSigning lets the user's API key sign requests checked by
+// SignedRequests, including a key made from an APISecret by
+// MigrateAPISecret.  The key is kept encrypted by the newest key of the
+// keyring, so calling it again re-encrypts the key once the keyring has
+// been rotated.  The user must be saved afterwards.
+func AllowSigning(keys web.Keyring, user *models.User, apiKey string) error {
+	id, hash := models.APIKeyID(apiKey), models.HashAPIKey(apiKey)
+	for i := range user.APIKeys {
+		k := &user.APIKeys[i]
+		if k.ID != id || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		aead, err := sealCipher(keys.Keys()[0].Hash)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		k.Sealed = base64.RawURLEncoding.EncodeToString(
+			aead.Seal(nonce, nonce, []byte(apiKey), []byte(k.ID)))
+		return nil
+	}
+	return fmt.Errorf("User %s has no API key %s", user.ID.Hex(), id)
+}
+
+// unsealAPIKey decrypts the API key sealed by AllowSigning with whichever
+// key of the keyring it was sealed with
+func unsealAPIKey(keys web.Keyring, key *models.APIKey) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(key.Sealed)
+	if err != nil {
+		return "", fmt.Errorf("Invalid sealed API key %s: %v", key.ID, err)
+	}
+	for _, k := range keys.Keys() {
+		aead, err := sealCipher(k.Hash)
+		if err != nil {
+			return "", err
+		}
+		n := aead.NonceSize()
+		if len(sealed) < n {
+			break
+		}
+		if b, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(key.ID)); err == nil {
+			return string(b), nil
+		}
+	}
+	return "", fmt.Errorf("API key %s was sealed by a key no longer in the keyring", key.ID)
+}
+
+// sealCipher returns the cipher sealing API keys, with a key derived from
+// the hash key so that it is never used for anything else
+func sealCipher(hash []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, hash)
+	io.WriteString(m, "web.security.seal")
+	block, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type signingTransport struct {
+	keyID  string
+	secret []byte
+	base   http.RoundTripper
+}
+
+// SigningTransport returns an http.RoundTripper which signs requests with
+// the API key, for services using SignedRequests once AllowSigning has been
+// called for the key.  Requests are sent with base, or http.DefaultTransport
+// if it is nil.
+func SigningTransport(apiKey string, base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if apiKey == "" {
+		return nil, errors.New("Requests cannot be signed without an API key")
+	}
+	return &signingTransport{
+		keyID:  models.APIKeyID(apiKey),
+		secret: []byte(apiKey),
+		base:   base,
+	}, nil
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// a RoundTripper must not modify the request it is given
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	signed.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	n := base64.RawURLEncoding.EncodeToString(nonce)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signature := signRequest(t.secret, req.Method, host, req.URL.RequestURI(),
+		hashHex(body), timestamp, n)
+	signed.Header.Set("Authorization", fmt.Sprintf(
+		"%s KeyId=%s, Timestamp=%s, Nonce=%s, Signature=%s", signatureScheme,
+		t.keyID, timestamp, n, base64.StdEncoding.EncodeToString(signature)))
+	return t.base.RoundTrip(signed)
+}
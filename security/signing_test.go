@@ -0,0 +1,183 @@
+package security_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+	"github.com/goincremental/web/webtest"
+)
+
+// captureTransport records the requests it is given instead of sending them
+type captureTransport struct {
+	requests []*http.Request
+}
+
+func (c *captureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, r)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+}
+
+type signingFixture struct {
+	apiKey string
+	keyID  string
+	server http.Handler
+}
+
+// newSigningFixture serves requests signed by a user whose API key has been
+// allowed to sign them by the keyring sealing
+func newSigningFixture(t *testing.T, sealing, keys web.Keyring) *signingFixture {
+	conn := webtest.NewConnection()
+	user := models.User{SystemID: testSystemID, Email: "svc@example.com"}
+	apiKey, key, _ := user.AddAPIKey("svc", nil, time.Time{})
+	if err := security.AllowSigning(sealing, &user, apiKey); err != nil {
+		t.Fatal(err)
+	}
+	db := conn.DB("app")
+	user.Save(&db)
+
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.Use(security.SignedRequests(security.SignatureOptions{
+		SystemID: testSystemID,
+		Keys:     keys,
+	}))
+	s.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if u := security.GetUser(r); u != nil {
+			w.Write([]byte(u.Email + ":" + string(b)))
+		}
+	}))
+	return &signingFixture{apiKey: apiKey, keyID: key.ID, server: s}
+}
+
+// sign returns the request as signed by a client holding the API key, ready
+// to be served
+func (f *signingFixture) sign(t *testing.T, apiKey, method, url, body string) *http.Request {
+	t.Helper()
+	capture := &captureTransport{}
+	transport, err := security.SigningTransport(apiKey, capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	return received(capture.requests[0])
+}
+
+// received turns a request made by a client into one received by a server
+func received(sent *http.Request) *http.Request {
+	var body []byte
+	if sent.Body != nil {
+		body, _ = io.ReadAll(sent.Body)
+	}
+	r := httptest.NewRequest(sent.Method, sent.URL.String(), bytes.NewReader(body))
+	r.Header = sent.Header.Clone()
+	return r
+}
+
+func (f *signingFixture) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	f.server.ServeHTTP(w, r)
+	return w
+}
+
+func TestSignedRequests(t *testing.T) {
+	keys := testKeyring(t)
+	f := newSigningFixture(t, keys, keys)
+
+	r := f.sign(t, f.apiKey, "POST", "https://api.example.com/things?a=1", "payload")
+	replay := r.Clone(r.Context())
+	if w := f.serve(r); w.Code != http.StatusOK || w.Body.String() != "svc@example.com:payload" {
+		t.Fatalf("signed request got %d %q", w.Code, w.Body)
+	}
+
+	replay.Body = io.NopCloser(strings.NewReader("payload"))
+	if w := f.serve(replay); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed request got %d", w.Code)
+	}
+
+	tampered := f.sign(t, f.apiKey, "POST", "https://api.example.com/things", "payload")
+	tampered.Body = io.NopCloser(strings.NewReader("tampered"))
+	if w := f.serve(tampered); w.Code != http.StatusUnauthorized {
+		t.Errorf("tampered body got %d", w.Code)
+	}
+
+	// a request signed for one service cannot be used against another
+	other := f.sign(t, f.apiKey, "GET", "https://api.example.com/things", "")
+	other.Host = "billing.example.com"
+	if w := f.serve(other); w.Code != http.StatusUnauthorized {
+		t.Errorf("request for another host got %d", w.Code)
+	}
+
+	if w := f.serve(httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("unsigned request got %d %q", w.Code, w.Body)
+	}
+}
+
+// The stored hash of an API key must not be enough to sign requests, and
+// keys must be allowed to sign them
+func TestSignedRequestsNeedAPIKey(t *testing.T) {
+	keys := testKeyring(t)
+	f := newSigningFixture(t, keys, keys)
+	forged := "ak_" + f.keyID + "_forged"
+	r := f.sign(t, forged, "GET", "https://api.example.com/", "")
+	if w := f.serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("request signed with another secret got %d", w.Code)
+	}
+
+	user := models.User{SystemID: testSystemID}
+	apiKey, _, _ := user.AddAPIKey("svc", nil, time.Time{})
+	if err := security.AllowSigning(keys, &models.User{}, apiKey); err == nil {
+		t.Error("signing allowed for a key the user does not have")
+	}
+	conn := webtest.NewConnection()
+	db := conn.DB("app")
+	user.Save(&db)
+	s := web.NewServer()
+	s.Use(web.Database(conn, "app"))
+	s.Use(security.SignedRequests(security.SignatureOptions{SystemID: testSystemID, Keys: keys}))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, f.sign(t, apiKey, "GET", "https://api.example.com/", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("key not allowed to sign got %d", w.Code)
+	}
+}
+
+func TestSigningKeyringRotation(t *testing.T) {
+	oldKey := web.SigningKey{Hash: bytes.Repeat([]byte("o"), 32)}
+	oldKeys, _ := web.NewKeyring(oldKey)
+	rotated, _ := web.NewKeyring(web.SigningKey{Hash: bytes.Repeat([]byte("n"), 32)}, oldKey)
+	f := newSigningFixture(t, oldKeys, rotated)
+
+	// keys sealed before the rotation keep working
+	r := f.sign(t, f.apiKey, "GET", "https://api.example.com/", "")
+	if w := f.serve(r); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("key sealed by the old keyring got %d", w.Code)
+	}
+
+	newOnly, _ := web.NewKeyring(web.SigningKey{Hash: bytes.Repeat([]byte("n"), 32)})
+	f = newSigningFixture(t, oldKeys, newOnly)
+	r = f.sign(t, f.apiKey, "GET", "https://api.example.com/", "")
+	if w := f.serve(r); w.Code != http.StatusInternalServerError {
+		t.Errorf("key sealed by a removed keyring key got %d", w.Code)
+	}
+}
+
+func TestSignedRequestsNeedKeyring(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("SignedRequests made without a keyring")
+		}
+	}()
+	security.SignedRequests(security.SignatureOptions{SystemID: testSystemID})
+}
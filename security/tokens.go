@@ -0,0 +1,137 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security/models"
+)
+
+// Purposes of the tokens issued to users
+const (
+	TokenPasswordReset     = "passwordReset"
+	TokenEmailVerification = "emailVerification"
+)
+
+// ErrInvalidToken is returned when a token is not genuine, has expired or
+// has already been used
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// IssueToken creates a token for the purpose, signed by the keyring, which
+// can be redeemed once within ttl.  A hash of the token is saved against
+// the user, replacing any earlier token for the same purpose.  The token is
+// bound to the user's email, so it stops working if the email changes.
+func IssueToken(db *dal.Database, keys web.Keyring, user *models.User,
+	purpose string, ttl time.Duration) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ttl)
+	payload := strings.Join([]string{
+		user.ID.Hex(),
+		purpose,
+		strconv.FormatInt(expires.Unix(), 10),
+		emailHash(user.Email),
+		base64.RawURLEncoding.EncodeToString(secret),
+	}, ".")
+
+	tokens := []models.UserToken{{
+		Purpose: purpose,
+		Hash:    tokenHash(secret),
+		Expires: expires,
+	}}
+	for _, t := range user.Tokens {
+		if t.Purpose != purpose && t.Expires.After(time.Now()) {
+			tokens = append(tokens, t)
+		}
+	}
+	user.Tokens = tokens
+	if err := user.Save(db); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + keys.Sign([]byte(payload)), nil
+}
+
+// RedeemToken checks the token was issued for the purpose to a user in the
+// system, and has not expired or been used, and returns the user.  The
+// token is removed from the user in a single update, so that it can only be
+// redeemed once even by requests made at the same time.
+func RedeemToken(db *dal.Database, keys web.Keyring, systemID dal.ObjectID,
+	purpose, token string) (*models.User, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !keys.Verify(payload, signature) {
+		return nil, ErrInvalidToken
+	}
+	parts := strings.Split(string(payload), ".")
+	if len(parts) != 5 || parts[1] != purpose || !dal.IsObjectIDHex(parts[0]) {
+		return nil, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrInvalidToken
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	id := dal.ObjectIDHex(parts[0])
+	user, err := models.GetUserByID(db, &systemID, &id)
+	if errors.Is(err, dal.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[3]), []byte(emailHash(user.Email))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	hash := tokenHash(secret)
+	for i, t := range user.Tokens {
+		if t.Purpose != purpose ||
+			subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if time.Now().After(t.Expires) {
+			return nil, ErrInvalidToken
+		}
+		err := user.RemoveToken(db, hash)
+		if errors.Is(err, dal.ErrNotFound) {
+			// another request redeemed the token first
+			return nil, ErrInvalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		user.Tokens = append(user.Tokens[:i:i], user.Tokens[i+1:]...)
+		return &user, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+// emailHash identifies the email a token was issued for without revealing
+// it in the token
+func emailHash(email string) string {
+	sum := sha256.Sum256([]byte(models.NormalizeEmail(email)))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+func tokenHash(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
@@ -37,10 +37,12 @@ type Server interface {
 	Use(handler Middleware)
 	UseHandler(http.Handler)
 	ServeHTTP(rw http.ResponseWriter, r *http.Request)
+	HealthChecks() HealthChecks
 }
 
 type server struct {
 	negroni *negroni.Negroni
+	health  *healthChecks
 }
 
 func (s *server) Run(port string) {
@@ -59,7 +61,15 @@ func (s *server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	s.negroni.ServeHTTP(rw, r)
 }
 
+// HealthChecks returns the checks run by the server's health endpoints,
+// which are only served once HealthChecks.Serve has been called
+func (s *server) HealthChecks() HealthChecks {
+	return s.health
+}
+
 func NewServer() Server {
 	n := negroni.Classic()
-	return &server{negroni: n}
+	h := newHealthChecks()
+	n.Use(h)
+	return &server{negroni: n, health: h}
 }
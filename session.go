@@ -15,15 +15,29 @@
 package web
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/codegangsta/negroni"
 	"github.com/goincremental/dal"
 	"github.com/goincremental/negroni-sessions"
 	"github.com/goincremental/negroni-sessions/dalstore"
+	gsessions "github.com/gorilla/sessions"
 )
 
 type Session interface {
 	sessions.Session
+	// Regenerate moves the session to a new id, leaving its values intact.
+	// It should be called whenever the user logs in or their privileges
+	// change, so that a session id obtained beforehand cannot be used.
+	Regenerate()
+	// Destroy removes the session from the store and expires its cookie
+	Destroy()
 }
 
 // Store is an interface for custom session stores.
@@ -31,16 +45,382 @@ type Store interface {
 	sessions.Store
 }
 
-func Sessions(name string, store Store) MiddlewareFunc {
-	return MiddlewareFunc(sessions.Sessions(name, store))
+// keys of the values used to enforce the session options
+const (
+	sessionCreatedKey   = "_created"
+	sessionLastSeenKey  = "_lastSeen"
+	sessionUserAgentKey = "_userAgent"
+)
+
+// lastSeenInterval limits how often the last seen time is updated when the
+// session has not otherwise changed
+const lastSeenInterval = time.Minute
+
+type sessionOptions struct {
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	bindUserAgent   bool
+	secure          bool
+	httpOnly        bool
+	sameSite        http.SameSite
+	index           sessionTracker
+}
+
+// SessionOption configures the Sessions middleware
+type SessionOption func(*sessionOptions)
+
+// IdleTimeout expires sessions which have not been used for d
+func IdleTimeout(d time.Duration) SessionOption {
+	return func(o *sessionOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// AbsoluteTimeout expires sessions d after they were created, however
+// recently they have been used
+func AbsoluteTimeout(d time.Duration) SessionOption {
+	return func(o *sessionOptions) {
+		o.absoluteTimeout = d
+	}
+}
+
+// BindUserAgent expires sessions which are presented by a different user
+// agent to the one that created them
+func BindUserAgent() SessionOption {
+	return func(o *sessionOptions) {
+		o.bindUserAgent = true
+	}
+}
+
+// SessionCookie sets the attributes of the session cookie.  By default the
+// cookie is Secure, HttpOnly and SameSite=Lax, so Secure must be turned off
+// to use sessions over plain http during development.
+func SessionCookie(secure, httpOnly bool, sameSite http.SameSite) SessionOption {
+	return func(o *sessionOptions) {
+		o.secure = secure
+		o.httpOnly = httpOnly
+		o.sameSite = sameSite
+	}
+}
+
+// Sessions is middleware that makes the named session available on the
+// request context through GetSession.  The session is loaded from the store
+// when it is first used, and saved before the response is written if it has
+// been changed.
+func Sessions(name string, store Store, opts ...SessionOption) MiddlewareFunc {
+	o := &sessionOptions{
+		secure:   true,
+		httpOnly: true,
+		sameSite: http.SameSiteLaxMode,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return MiddlewareFunc(func(rw http.ResponseWriter, r *http.Request,
+		next http.HandlerFunc) {
+		res, ok := rw.(negroni.ResponseWriter)
+		if !ok {
+			res = negroni.NewResponseWriter(rw)
+		}
+		s := &session{name: name, store: store, opts: o, request: r, rw: res}
+		res.Before(func(negroni.ResponseWriter) {
+			s.save()
+		})
+		sessionKey.Set(r, s)
+		sessionStoreKey.Set(r, store)
+
+		next(res, r)
+
+		if !res.Written() {
+			s.save()
+		}
+	})
+}
+
+type session struct {
+	name    string
+	store   Store
+	opts    *sessionOptions
+	request *http.Request
+	rw      http.ResponseWriter
+
+	session *gsessions.Session
+	// custom is set once the application sets its own cookie options
+	custom  bool
+	written bool
+	saved   bool
+	// oldID is the id the session had before it was regenerated, which is
+	// removed from the store when the session is saved
+	oldID string
+}
+
+// load fetches the session from the store the first time it is needed,
+// discarding it if it breaks the session options
+func (s *session) load() *gsessions.Session {
+	if s.session != nil {
+		return s.session
+	}
+	gs, err := s.store.Get(s.request, s.name)
+	if err != nil {
+		// the store still returns a new session when the cookie is invalid
+		log.Printf("Unable to load session %s: %v", s.name, err)
+	}
+	if gs == nil {
+		gs = gsessions.NewSession(s.store, s.name)
+		gs.Options = &gsessions.Options{Path: "/"}
+		gs.IsNew = true
+	}
+	s.session = gs
+	if gs.IsNew {
+		return gs
+	}
+	active, err := s.active(gs)
+	if err != nil {
+		// fail closed with an empty session for this request, leaving the
+		// stored session alone as it may still be active
+		log.Printf("Unable to check session %s is active: %v", s.name, err)
+		opts := *gs.Options
+		gs = gsessions.NewSession(s.store, s.name)
+		gs.Options = &opts
+		gs.IsNew = true
+		s.session = gs
+		return gs
+	}
+
+	now := time.Now()
+	created := time.Unix(sessionTime(gs.Values[sessionCreatedKey]), 0)
+	lastSeen := time.Unix(sessionTime(gs.Values[sessionLastSeenKey]), 0)
+	switch {
+	case s.opts.idleTimeout > 0 && now.Sub(lastSeen) > s.opts.idleTimeout,
+		s.opts.absoluteTimeout > 0 && now.Sub(created) > s.opts.absoluteTimeout,
+		s.opts.bindUserAgent && gs.Values[sessionUserAgentKey] != userAgentFingerprint(s.request),
+		!active:
+		gs.Values = map[interface{}]interface{}{}
+		s.Regenerate()
+		gs.IsNew = true
+	case now.Sub(lastSeen) >= lastSeenInterval:
+		s.written = true
+	}
+	return gs
+}
+
+// active reports whether the session is still active in the SessionIndex.
+// Sessions are always active when they are not tracked.
+func (s *session) active(gs *gsessions.Session) (bool, error) {
+	sid, ok := gs.Values[sessionTrackingKey].(string)
+	if s.opts.index == nil || !ok {
+		return true, nil
+	}
+	return s.opts.index.touch(sid, gs.ID)
+}
+
+func sessionTime(v interface{}) int64 {
+	switch t := v.(type) {
+	case int64:
+		return t
+	case int:
+		return int64(t)
+	case float64:
+		return int64(t)
+	}
+	return 0
+}
+
+func userAgentFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (s *session) save() {
+	if s.session == nil || !s.written || s.saved {
+		return
+	}
+	s.saved = true
+	gs := s.session
+
+	if s.oldID != "" {
+		old := gsessions.NewSession(s.store, s.name)
+		old.ID = s.oldID
+		opts := *gs.Options
+		opts.MaxAge = -1
+		old.Options = &opts
+		// only the stored session is removed, the cookie is replaced below
+		if err := s.store.Save(s.request, discardResponse{}, old); err != nil {
+			log.Printf("Unable to remove session %s: %v", s.name, err)
+		}
+	}
+
+	if !s.custom {
+		gs.Options.Secure = s.opts.secure
+		gs.Options.HttpOnly = s.opts.httpOnly
+	}
+	gs.Options.SameSite = s.opts.sameSite
+	if gs.Options.MaxAge >= 0 {
+		now := time.Now().Unix()
+		if _, ok := gs.Values[sessionCreatedKey]; !ok {
+			gs.Values[sessionCreatedKey] = now
+		}
+		gs.Values[sessionLastSeenKey] = now
+		if s.opts.bindUserAgent {
+			gs.Values[sessionUserAgentKey] = userAgentFingerprint(s.request)
+		}
+	}
+	if err := gs.Save(s.request, s.rw); err != nil {
+		log.Printf("Unable to save session %s: %v", s.name, err)
+	}
+}
+
+func (s *session) Get(key interface{}) interface{} {
+	return s.load().Values[key]
+}
+
+func (s *session) Set(key interface{}, val interface{}) {
+	s.load().Values[key] = val
+	s.written = true
+}
+
+func (s *session) Delete(key interface{}) {
+	delete(s.load().Values, key)
+	s.written = true
+}
+
+// Clear removes every value from the session, except those used to enforce
+// the session options
+func (s *session) Clear() {
+	gs := s.load()
+	for key := range gs.Values {
+		switch key {
+		case sessionCreatedKey, sessionLastSeenKey, sessionUserAgentKey:
+		default:
+			delete(gs.Values, key)
+		}
+	}
+	s.written = true
+}
+
+func (s *session) AddFlash(value interface{}, vars ...string) {
+	s.load().AddFlash(value, vars...)
+	s.written = true
+}
+
+// Flashes removes and returns the flashes, so the session only needs saving
+// when there were some
+func (s *session) Flashes(vars ...string) []interface{} {
+	flashes := s.load().Flashes(vars...)
+	if len(flashes) > 0 {
+		s.written = true
+	}
+	return flashes
 }
 
+func (s *session) Options(o sessions.Options) {
+	opts := gorillaOptions(o)
+	s.load().Options = &opts
+	s.custom = true
+	s.written = true
+}
+
+func (s *session) Regenerate() {
+	gs := s.load()
+	if s.oldID == "" {
+		s.oldID = gs.ID
+	}
+	gs.ID = ""
+	delete(gs.Values, sessionCreatedKey)
+	s.written = true
+}
+
+func (s *session) Destroy() {
+	gs := s.load()
+	gs.Values = map[interface{}]interface{}{}
+	opts := *gs.Options
+	opts.MaxAge = -1
+	gs.Options = &opts
+	s.written = true
+}
+
+// discardResponse is used to remove a session from its store without
+// setting a cookie on the real response
+type discardResponse struct{}
+
+func (discardResponse) Header() http.Header         { return http.Header{} }
+func (discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponse) WriteHeader(int)             {}
+
+// GetSession retrieves the session loaded by the Sessions middleware
 func GetSession(req *http.Request) Session {
-	return sessions.GetSession(req)
+	rv, _ := sessionKey.Get(req)
+	return rv
+}
+
+// SetSession stores the session on the request, in place of one loaded by
+// the Sessions middleware
+func SetSession(req *http.Request, val Session) {
+	sessionKey.Set(req, val)
 }
 
 // NewSessionStore returns a new SessionStore (currently uses default dalstore implementation)
 // Set ensureTTL to true let the database auto-remove expired object by maxAge.
+// Use NewStore with a Keyring for a dal store whose keys can be rotated.
 func NewSessionStore(c dal.Connection, database string, collection string, maxAge int, ensureTTL bool, keyPairs ...[]byte) Store {
-	return dalstore.New(c, database, collection, maxAge, ensureTTL, keyPairs...)
+	return &dalStore{
+		store: dalstore.New(c, database, collection, maxAge, ensureTTL, keyPairs...),
+		ping:  DatabaseCheck(c, database),
+		create: func(keyPairs [][]byte) Store {
+			// the first store has already ensured the TTL index
+			return dalstore.New(c, database, collection, maxAge, false, keyPairs...)
+		},
+	}
+}
+
+// dalStore adds a Ping to the dalstore so that its database can be included
+// in the health checks with SessionStoreCheck.  The dalstore has no way to
+// change its keys, so it is replaced with one created with the new keys
+// when they are rotated.
+type dalStore struct {
+	mu      sync.RWMutex
+	store   Store
+	options *sessions.Options
+	ping    HealthCheck
+	create  func(keyPairs [][]byte) Store
+}
+
+func (s *dalStore) current() Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store
+}
+
+func (s *dalStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return s.current().Get(r, name)
+}
+
+func (s *dalStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	return s.current().New(r, name)
+}
+
+func (s *dalStore) Save(r *http.Request, w http.ResponseWriter,
+	session *gsessions.Session) error {
+	return s.current().Save(r, w, session)
+}
+
+func (s *dalStore) Options(o sessions.Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options = &o
+	s.store.Options(o)
+}
+
+func (s *dalStore) setKeyPairs(keyPairs [][]byte) {
+	store := s.create(keyPairs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.options != nil {
+		store.Options(*s.options)
+	}
+	s.store = store
+}
+
+func (s *dalStore) Ping() error {
+	return s.ping(context.Background())
 }
@@ -0,0 +1,58 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goincremental/negroni-sessions"
+)
+
+// The dal store is replaced when its keys rotate, which must keep its
+// options and the sessions it holds
+func TestDalStoreRotation(t *testing.T) {
+	backend := newMemoryBackend()
+	oldKeys := [][]byte{bytes.Repeat([]byte("a"), 32)}
+	newKeys := [][]byte{bytes.Repeat([]byte("b"), 32), nil, oldKeys[0]}
+	var store rotatableStore = &dalStore{
+		store: newServerStore(backend, oldKeys),
+		create: func(keyPairs [][]byte) Store {
+			return newServerStore(backend, keyPairs)
+		},
+	}
+	s := store.(Store)
+	s.Options(sessions.Options{Path: "/app", MaxAge: 60})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	gs, _ := s.New(r, "sid")
+	gs.Values["a"] = "b"
+	w := httptest.NewRecorder()
+	if err := s.Save(r, w, gs); err != nil {
+		t.Fatal(err)
+	}
+
+	store.setKeyPairs(newKeys)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	gs, err := s.Get(r, "sid")
+	if err != nil || gs.Values["a"] != "b" {
+		t.Fatalf("session of the old key not loaded: %v", err)
+	}
+	if gs.Options.Path != "/app" || gs.Options.MaxAge != 60 {
+		t.Errorf("options lost on rotation: %+v", gs.Options)
+	}
+}
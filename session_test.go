@@ -0,0 +1,165 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+// sessionClient sends requests to a server, keeping the session cookie it
+// is given like a browser would
+type sessionClient struct {
+	t       *testing.T
+	h       http.Handler
+	cookies map[string]*http.Cookie
+	ua      string
+}
+
+func newSessionClient(t *testing.T, h http.Handler) *sessionClient {
+	return &sessionClient{t: t, h: h, cookies: map[string]*http.Cookie{}}
+}
+
+func (c *sessionClient) get(path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("User-Agent", c.ua)
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	c.h.ServeHTTP(w, r)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+func sessionServer(t *testing.T, opts ...web.SessionOption) http.Handler {
+	store, err := web.NewStore(web.StoreOptions{
+		Type:     web.StoreMemory,
+		KeyPairs: [][]byte{testHashKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := web.NewRouter()
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		s := web.GetSession(r)
+		s.Regenerate()
+		s.Set("user", "u1")
+	})
+	r.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		v, _ := web.GetSession(r).Get("user").(string)
+		w.Write([]byte(v))
+	})
+	r.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		web.GetSession(r).Destroy()
+	})
+	r.HandleFunc("/flash", func(w http.ResponseWriter, r *http.Request) {
+		web.AddFlash(r, "info", "saved")
+	})
+	r.HandleFunc("/flashes", func(w http.ResponseWriter, r *http.Request) {
+		for _, f := range web.Flashes(r) {
+			w.Write([]byte(f.Message))
+		}
+	})
+
+	s := web.NewServer()
+	s.Use(web.Sessions("sid", store, opts...))
+	s.UseHandler(r)
+	return s
+}
+
+func TestSessionCookie(t *testing.T) {
+	c := newSessionClient(t, sessionServer(t))
+	c.get("/login")
+	cookie := c.cookies["sid"]
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+	if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("cookie %+v", cookie)
+	}
+	if body := c.get("/user").Body.String(); body != "u1" {
+		t.Errorf("user %q", body)
+	}
+}
+
+func TestSessionRegenerate(t *testing.T) {
+	c := newSessionClient(t, sessionServer(t))
+	c.get("/flash")
+	before := *c.cookies["sid"]
+	c.get("/login")
+	if c.cookies["sid"].Value == before.Value {
+		t.Fatal("session id was not regenerated")
+	}
+
+	// the session stored under the old id is gone
+	old := newSessionClient(t, c.h)
+	old.cookies["sid"] = &before
+	if body := old.get("/flashes").Body.String(); body != "" {
+		t.Errorf("old session still holds %q", body)
+	}
+}
+
+func TestSessionDestroy(t *testing.T) {
+	c := newSessionClient(t, sessionServer(t))
+	c.get("/login")
+	kept := *c.cookies["sid"]
+	c.get("/logout")
+	c.cookies["sid"] = &kept
+	if body := c.get("/user").Body.String(); body != "" {
+		t.Errorf("destroyed session still holds %q", body)
+	}
+}
+
+func TestSessionBindUserAgent(t *testing.T) {
+	c := newSessionClient(t, sessionServer(t, web.BindUserAgent()))
+	c.ua = "browser"
+	c.get("/login")
+	c.ua = "other"
+	if body := c.get("/user").Body.String(); body != "" {
+		t.Errorf("session used from another user agent: %q", body)
+	}
+}
+
+func TestSessionFlashes(t *testing.T) {
+	c := newSessionClient(t, sessionServer(t))
+	c.get("/login")
+
+	// reading flashes when there are none leaves the session alone
+	if w := c.get("/flashes"); len(w.Result().Cookies()) != 0 {
+		t.Errorf("session saved with no flashes: %v", w.Result().Cookies())
+	}
+
+	c.get("/flash")
+	w := c.get("/flashes")
+	if w.Body.String() != "saved" {
+		t.Errorf("flashes %q", w.Body)
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Error("session not saved once flashes were removed")
+	}
+	if body := c.get("/flashes").Body.String(); body != "" {
+		t.Errorf("flashes shown twice: %q", body)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/goincremental/dal"
+)
+
+// keys of the values used to track the logged in user of a session
+const (
+	sessionUserKey     = "_userId"
+	sessionTrackingKey = "_sessionId"
+)
+
+// SessionInfo describes one of a user's sessions
+type SessionInfo struct {
+	ID        string       `bson:"_id" json:"id"`
+	UserID    dal.ObjectID `bson:"userId" json:"userId"`
+	Created   time.Time    `bson:"created" json:"created"`
+	LastSeen  time.Time    `bson:"lastSeen" json:"lastSeen"`
+	IP        string       `bson:"ip" json:"ip"`
+	UserAgent string       `bson:"userAgent" json:"userAgent"`
+
+	// Expires is when the index forgets the session if it is not seen again
+	Expires time.Time `bson:"expires" json:"expires"`
+	// StoreID is the id of the session in the session store, for stores
+	// which keep sessions on the server
+	StoreID string `bson:"storeId,omitempty" json:"-"`
+}
+
+// SessionIndex lists and revokes the sessions of each logged in user.  The
+// index made by NewSessionIndex is passed to the Sessions middleware with
+// TrackSessions, and sessions are added to it by SessionLogin.  A revoked
+// session is emptied the next time it is used, and a session is treated as
+// empty for any request on which the index cannot be reached.
+type SessionIndex interface {
+	List(userID dal.ObjectID) ([]SessionInfo, error)
+	Revoke(userID dal.ObjectID, sessionID string) error
+	RevokeAll(userID dal.ObjectID) error
+}
+
+// sessionTracker is a SessionIndex which the Sessions middleware can keep
+// up to date
+type sessionTracker interface {
+	SessionIndex
+	track(sessionID string, userID dal.ObjectID, r *http.Request) error
+	touch(sessionID, storeID string) (bool, error)
+}
+
+type sessionIndex struct {
+	conn       dal.Connection
+	database   string
+	collection string
+	maxAge     time.Duration
+}
+
+// NewSessionIndex creates a SessionIndex kept in the collection, which can
+// be the collection used by the dal session store, in which case revoking a
+// session also deletes it from the store.  Sessions not seen for maxAge, by
+// default the 30 days sessions last for, are no longer listed, and are
+// removed by a TTL index on their expiry.
+func NewSessionIndex(c dal.Connection, database, collection string,
+	maxAge time.Duration) SessionIndex {
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge * time.Second
+	}
+	i := &sessionIndex{conn: c, database: database, collection: collection, maxAge: maxAge}
+	err := i.with(func(col dal.Collection) error {
+		// the index expires documents a second after the time in the field
+		return col.EnsureIndex(dal.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	})
+	if err != nil {
+		log.Printf("Unable to create the TTL index of the session index: %v", err)
+	}
+	return i
+}
+
+// with runs f with the collection on a copy of the connection
+func (i *sessionIndex) with(f func(col dal.Collection) error) error {
+	c := i.conn.Clone()
+	defer c.Close()
+	return f(c.DB(i.database).C(i.collection))
+}
+
+func (i *sessionIndex) List(userID dal.ObjectID) (result []SessionInfo, err error) {
+	err = i.with(func(col dal.Collection) error {
+		return col.Find(dal.Q{
+			"userId":   userID,
+			"lastSeen": dal.Q{"$gt": time.Now().Add(-i.maxAge)},
+		}).All(&result)
+	})
+	return
+}
+
+func (i *sessionIndex) Revoke(userID dal.ObjectID, sessionID string) error {
+	return i.with(func(col dal.Collection) error {
+		var info SessionInfo
+		if err := col.FindID(sessionID).One(&info); err != nil {
+			return err
+		}
+		if info.UserID != userID {
+			return dal.ErrNotFound
+		}
+		if err := col.RemoveID(sessionID); err != nil {
+			return err
+		}
+		return removeStored(col, []SessionInfo{info})
+	})
+}
+
+func (i *sessionIndex) RevokeAll(userID dal.ObjectID) error {
+	return i.with(func(col dal.Collection) error {
+		var sessions []SessionInfo
+		if err := col.Find(dal.Q{"userId": userID}).All(&sessions); err != nil {
+			return err
+		}
+		if _, err := col.RemoveAll(dal.Q{"userId": userID}); err != nil {
+			return err
+		}
+		return removeStored(col, sessions)
+	})
+}
+
+// removeStored deletes the sessions from the store, when the index shares
+// the collection of the dal session store
+func removeStored(col dal.Collection, sessions []SessionInfo) error {
+	var ids []string
+	for _, s := range sessions {
+		if s.StoreID != "" {
+			ids = append(ids, s.StoreID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := col.RemoveAll(dal.Q{"_id": dal.Q{"$in": ids}})
+	return err
+}
+
+func (i *sessionIndex) track(sessionID string, userID dal.ObjectID,
+	r *http.Request) error {
+	now := time.Now()
+	info := SessionInfo{
+		ID:        sessionID,
+		UserID:    userID,
+		Created:   now,
+		LastSeen:  now,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		Expires:   now.Add(i.maxAge),
+	}
+	return i.with(func(col dal.Collection) error {
+		_, err := col.UpsertID(sessionID, info)
+		return err
+	})
+}
+
+// touch reports whether the session is still in the index, and updates the
+// time it was last seen and the id it has in the store
+func (i *sessionIndex) touch(sessionID, storeID string) (active bool, err error) {
+	err = i.with(func(col dal.Collection) error {
+		var info SessionInfo
+		if err := col.FindID(sessionID).One(&info); err != nil {
+			return err
+		}
+		active = true
+		if time.Since(info.LastSeen) < lastSeenInterval && info.StoreID == storeID {
+			return nil
+		}
+		now := time.Now()
+		// a session revoked since it was read is not brought back
+		return col.Update(dal.Q{"_id": sessionID}, dal.Q{"$set": dal.Q{
+			"lastSeen": now,
+			"expires":  now.Add(i.maxAge),
+			"storeId":  storeID,
+		}})
+	})
+	if errors.Is(err, dal.ErrNotFound) {
+		return false, nil
+	}
+	return
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// TrackSessions records the sessions of logged in users in index, which
+// must be made by NewSessionIndex
+func TrackSessions(index SessionIndex) SessionOption {
+	tracker, ok := index.(sessionTracker)
+	if !ok {
+		panic("web: TrackSessions needs an index made by NewSessionIndex")
+	}
+	return func(o *sessionOptions) {
+		o.index = tracker
+	}
+}
+
+// SessionLogin records that the user has logged in to the session on the
+// request.  The session is regenerated, and added to the SessionIndex if
+// sessions are tracked.
+func SessionLogin(r *http.Request, userID dal.ObjectID) error {
+	s := GetSession(r)
+	if s == nil {
+		return ErrNoSession
+	}
+	index := sessionIndexOf(s)
+	if sid, ok := s.Get(sessionTrackingKey).(string); ok && index != nil {
+		if err := index.Revoke(userID, sid); err != nil && !errors.Is(err, dal.ErrNotFound) {
+			return err
+		}
+	}
+	s.Regenerate()
+	s.Set(sessionUserKey, userID.Hex())
+	s.Delete(sessionTrackingKey)
+	if index == nil {
+		return nil
+	}
+	sid := newSessionID()
+	s.Set(sessionTrackingKey, sid)
+	return index.track(sid, userID, r)
+}
+
+// SessionLogout removes the user from the session on the request, revoking
+// the session in the SessionIndex and destroying it
+func SessionLogout(r *http.Request) error {
+	s := GetSession(r)
+	if s == nil {
+		return ErrNoSession
+	}
+	var err error
+	userID, ok := SessionUserID(r)
+	sid, tracked := s.Get(sessionTrackingKey).(string)
+	if index := sessionIndexOf(s); index != nil && ok && tracked {
+		if err = index.Revoke(userID, sid); errors.Is(err, dal.ErrNotFound) {
+			err = nil
+		}
+	}
+	s.Destroy()
+	return err
+}
+
+// SessionUserID returns the id of the user logged in to the session on the
+// request with SessionLogin
+func SessionUserID(r *http.Request) (dal.ObjectID, bool) {
+	s := GetSession(r)
+	if s == nil {
+		return dal.ObjectID(""), false
+	}
+	hex, ok := s.Get(sessionUserKey).(string)
+	if !ok || !dal.IsObjectIDHex(hex) {
+		return dal.ObjectID(""), false
+	}
+	return dal.ObjectIDHex(hex), true
+}
+
+// CurrentSessionID returns the id by which the session on the request is
+// known to the SessionIndex, so that it can be picked out of a user's
+// sessions
+func CurrentSessionID(r *http.Request) string {
+	s := GetSession(r)
+	if s == nil {
+		return ""
+	}
+	sid, _ := s.Get(sessionTrackingKey).(string)
+	return sid
+}
+
+func sessionIndexOf(s Session) sessionTracker {
+	if ss, ok := s.(*session); ok {
+		return ss.opts.index
+	}
+	return nil
+}
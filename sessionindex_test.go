@@ -0,0 +1,190 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/webtest"
+)
+
+// flakyConnection is a connection whose collections cannot be read while
+// down is set
+type flakyConnection struct {
+	dal.Connection
+	down *bool
+}
+
+func (c flakyConnection) Clone() dal.Connection {
+	return flakyConnection{c.Connection.Clone(), c.down}
+}
+
+func (c flakyConnection) DB(name string) dal.Database {
+	return flakyDatabase{c.Connection.DB(name), c.down}
+}
+
+type flakyDatabase struct {
+	dal.Database
+	down *bool
+}
+
+func (d flakyDatabase) C(name string) dal.Collection {
+	return flakyCollection{d.Database.C(name), d.down}
+}
+
+type flakyCollection struct {
+	dal.Collection
+	down *bool
+}
+
+func (c flakyCollection) FindID(id interface{}) dal.Query {
+	return flakyQuery{c.Collection.FindID(id), c.down}
+}
+
+type flakyQuery struct {
+	dal.Query
+	down *bool
+}
+
+func (q flakyQuery) One(result interface{}) error {
+	if *q.down {
+		return errors.New("no reachable servers")
+	}
+	return q.Query.One(result)
+}
+
+var testUserID = dal.ObjectIDHex("5f1d7c0a9b1e8a0001a1b2c3")
+
+func trackedServer(t *testing.T, index web.SessionIndex) http.Handler {
+	store, err := web.NewStore(web.StoreOptions{
+		Type:     web.StoreMemory,
+		KeyPairs: [][]byte{testHashKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := web.NewRouter()
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if err := web.SessionLogin(r, testUserID); err != nil {
+			t.Error(err)
+		}
+	})
+	r.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := web.SessionUserID(r); ok {
+			w.Write([]byte(id.Hex()))
+		}
+	})
+	s := web.NewServer()
+	s.Use(web.Sessions("sid", store, web.TrackSessions(index)))
+	s.UseHandler(r)
+	return s
+}
+
+func TestSessionIndex(t *testing.T) {
+	index := web.NewSessionIndex(webtest.NewConnection(), "app", "sessions", 0)
+	c := newSessionClient(t, trackedServer(t, index))
+	c.ua = "browser"
+	c.get("/login")
+
+	sessions, err := index.List(testUserID)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("listed %d sessions: %v", len(sessions), err)
+	}
+	if sessions[0].UserAgent != "browser" {
+		t.Errorf("session %+v", sessions[0])
+	}
+	if body := c.get("/user").Body.String(); body != testUserID.Hex() {
+		t.Errorf("user %q", body)
+	}
+
+	if err := index.RevokeAll(testUserID); err != nil {
+		t.Fatal(err)
+	}
+	if body := c.get("/user").Body.String(); body != "" {
+		t.Errorf("revoked session still has user %q", body)
+	}
+}
+
+func TestSessionIndexUnreachable(t *testing.T) {
+	down := false
+	conn := flakyConnection{webtest.NewConnection(), &down}
+	index := web.NewSessionIndex(conn, "app", "sessions", 0)
+	c := newSessionClient(t, trackedServer(t, index))
+	c.get("/login")
+
+	down = true
+	if body := c.get("/user").Body.String(); body != "" {
+		t.Errorf("session used while the index is unreachable: %q", body)
+	}
+	down = false
+	if body := c.get("/user").Body.String(); body != testUserID.Hex() {
+		t.Errorf("session lost once the index is back: %q", body)
+	}
+}
+
+// Revoking every session of a user removes them from the index, and from
+// the dal session store when it shares the index's collection
+func TestSessionIndexRevokeAll(t *testing.T) {
+	conn := webtest.NewConnection()
+	col := conn.DB("app").C("sessions")
+	index := web.NewSessionIndex(conn, "app", "sessions", time.Hour)
+	h := trackedServer(t, index)
+	for i := 0; i < 2; i++ {
+		c := newSessionClient(t, h)
+		c.get("/login")
+		c.get("/user")
+	}
+	other := web.SessionInfo{ID: "other", UserID: dal.NewObjectID(), StoreID: "stored-other"}
+	col.Insert(other)
+
+	sessions, err := index.List(testUserID)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("listed %d sessions: %v", len(sessions), err)
+	}
+	for _, s := range sessions {
+		if s.StoreID == "" {
+			t.Errorf("store id of %s not recorded", s.ID)
+		}
+		if d := s.Expires.Sub(s.LastSeen); d < time.Hour-time.Second || d > time.Hour {
+			t.Errorf("session %s expires %v after it was last seen", s.ID, d)
+		}
+		// stands in for the session in the dal session store
+		col.Insert(dal.Q{"_id": s.StoreID, "data": "values"})
+	}
+
+	if err := index.RevokeAll(testUserID); err != nil {
+		t.Fatal(err)
+	}
+	var left []dal.Q
+	col.Find(nil).All(&left)
+	if len(left) != 1 || left[0]["_id"] != "other" {
+		t.Errorf("left %v", left)
+	}
+}
+
+func TestTrackSessionsNeedsIndex(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("TrackSessions accepted an index it cannot track sessions in")
+		}
+	}()
+	var index struct{ web.SessionIndex }
+	web.TrackSessions(index)
+}
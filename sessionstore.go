@@ -0,0 +1,371 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+)
+
+// StoreType selects the session store created by NewStore
+type StoreType string
+
+const (
+	// StoreDal keeps sessions in a dal collection
+	StoreDal StoreType = "dal"
+	// StoreCookie keeps sessions in a signed and encrypted cookie with
+	// nothing kept on the server, so every key needs a block key
+	StoreCookie StoreType = "cookie"
+	// StoreMemory keeps sessions in memory, for tests and single instances
+	StoreMemory StoreType = "memory"
+	// StoreFile keeps sessions in files in a directory
+	StoreFile StoreType = "file"
+	// StoreRedis keeps sessions in redis, or any server speaking its protocol
+	StoreRedis StoreType = "redis"
+)
+
+// StoreOptions configures the store created by NewStore.  Only the fields
+// used by the chosen Type need to be set.
+type StoreOptions struct {
+	Type StoreType
+
+	// KeyPairs are the hash and block keys used to sign and encrypt cookies,
+	// as for securecookie.  A hash key is always required, and StoreCookie
+	// also requires a block key.
+	KeyPairs [][]byte
+
+	// Keyring supplies the key pairs in place of KeyPairs.  Stores switch
+	// to the new keys whenever the keyring is reloaded.
+	Keyring Keyring
+
+	// MaxAge is how long sessions last, in seconds
+	MaxAge int
+
+	// Connection, Database, Collection and EnsureTTL configure StoreDal
+	Connection dal.Connection
+	Database   string
+	Collection string
+	EnsureTTL  bool
+
+	// Path is the directory used by StoreFile
+	Path string
+
+	// Address, Password, DB and Prefix configure StoreRedis
+	Address  string
+	Password string
+	DB       int
+	Prefix   string
+}
+
+const defaultMaxAge = 86400 * 30
+
+// NewStore creates a session store of the requested type
+func NewStore(opts StoreOptions) (Store, error) {
+	if opts.Keyring != nil {
+		opts.KeyPairs = opts.Keyring.KeyPairs()
+	}
+	if len(opts.KeyPairs) == 0 {
+		return nil, fmt.Errorf("Session store needs at least one key")
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = defaultMaxAge
+	}
+
+	var store Store
+	var validate func(keyPairs [][]byte) error
+	switch opts.Type {
+	case StoreDal:
+		store = NewSessionStore(opts.Connection, opts.Database, opts.Collection,
+			opts.MaxAge, opts.EnsureTTL, opts.KeyPairs...)
+	case StoreCookie:
+		validate = requireBlockKeys
+		if err := validate(opts.KeyPairs); err != nil {
+			return nil, err
+		}
+		cs := gsessions.NewCookieStore(opts.KeyPairs...)
+		store = &gorillaStore{Store: cs, options: cs.Options, codecs: &cs.Codecs}
+	case StoreMemory:
+		store = newServerStore(newMemoryBackend(), opts.KeyPairs)
+	case StoreFile:
+		if opts.Path == "" {
+			return nil, fmt.Errorf("File session store needs a path")
+		}
+		if err := os.MkdirAll(opts.Path, 0700); err != nil {
+			return nil, err
+		}
+		fs := gsessions.NewFilesystemStore(opts.Path, opts.KeyPairs...)
+		store = &fileStore{
+			gorillaStore: gorillaStore{Store: fs, options: fs.Options, codecs: &fs.Codecs},
+			path:         opts.Path,
+		}
+	case StoreRedis:
+		if opts.Address == "" {
+			return nil, fmt.Errorf("Redis session store needs an address")
+		}
+		backend := newRedisBackend(opts.Address, opts.Password, opts.DB, opts.Prefix)
+		store = newServerStore(backend, opts.KeyPairs)
+	default:
+		return nil, fmt.Errorf("Unknown session store type %q", opts.Type)
+	}
+	store.Options(sessions.Options{Path: "/", MaxAge: opts.MaxAge})
+
+	if r, ok := store.(rotatableStore); ok && opts.Keyring != nil {
+		keys := opts.Keyring
+		keys.OnReload(func() {
+			keyPairs := keys.KeyPairs()
+			if validate != nil {
+				if err := validate(keyPairs); err != nil {
+					log.Printf("Keeping the previous session keys: %v", err)
+					return
+				}
+			}
+			r.setKeyPairs(keyPairs)
+		})
+	}
+	return store, nil
+}
+
+// requireBlockKeys checks that every hash key is paired with a block key, as
+// sessions kept by the client must not be readable by it
+func requireBlockKeys(keyPairs [][]byte) error {
+	for i := 0; i < len(keyPairs); i += 2 {
+		if i+1 == len(keyPairs) || len(keyPairs[i+1]) == 0 {
+			return fmt.Errorf("Cookie session store needs a block key for key %d", i/2+1)
+		}
+	}
+	return nil
+}
+
+// rotatableStore is implemented by stores which can switch keys while in
+// use
+type rotatableStore interface {
+	setKeyPairs(keyPairs [][]byte)
+}
+
+// newCodecs creates the codecs for the key pairs, with the max age of the
+// cookies they sign set to maxAge
+func newCodecs(keyPairs [][]byte, maxAge int) []securecookie.Codec {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(maxAge)
+		}
+	}
+	return codecs
+}
+
+func gorillaOptions(o sessions.Options) gsessions.Options {
+	return gsessions.Options{
+		Path:     o.Path,
+		Domain:   o.Domain,
+		MaxAge:   o.MaxAge,
+		Secure:   o.Secure,
+		HttpOnly: o.HTTPOnly,
+	}
+}
+
+// gorillaStore adapts a store from gorilla/sessions, which is configured
+// through its Options and Codecs fields, to the Store interface
+type gorillaStore struct {
+	gsessions.Store
+	mu      sync.RWMutex
+	options *gsessions.Options
+	codecs  *[]securecookie.Codec
+}
+
+func (s *gorillaStore) Options(o sessions.Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.options = gorillaOptions(o)
+	for _, c := range *s.codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(o.MaxAge)
+		}
+	}
+}
+
+func (s *gorillaStore) setKeyPairs(keyPairs [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.codecs = newCodecs(keyPairs, s.options.MaxAge)
+}
+
+func (s *gorillaStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.Get(r, name)
+}
+
+func (s *gorillaStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.New(r, name)
+}
+
+func (s *gorillaStore) Save(r *http.Request, w http.ResponseWriter,
+	session *gsessions.Session) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.Save(r, w, session)
+}
+
+type fileStore struct {
+	gorillaStore
+	path string
+}
+
+func (s *fileStore) Ping() error {
+	_, err := os.Stat(s.path)
+	return err
+}
+
+// sessionBackend holds the encoded values of sessions kept on the server,
+// keyed by session id.  load returns nil data for unknown sessions.
+type sessionBackend interface {
+	load(id string) ([]byte, error)
+	save(id string, data []byte, ttl time.Duration) error
+	delete(id string) error
+	ping() error
+}
+
+// serverStore keeps session values in a backend, and only a signed session
+// id in the cookie
+type serverStore struct {
+	backend  sessionBackend
+	mu       sync.RWMutex
+	keyPairs [][]byte
+	codecs   []securecookie.Codec
+	options  *gsessions.Options
+}
+
+func newServerStore(backend sessionBackend, keyPairs [][]byte) *serverStore {
+	return &serverStore{
+		backend:  backend,
+		keyPairs: keyPairs,
+		codecs:   newCodecs(keyPairs, defaultMaxAge),
+		options:  &gsessions.Options{Path: "/", MaxAge: defaultMaxAge},
+	}
+}
+
+func (s *serverStore) Options(o sessions.Options) {
+	opts := gorillaOptions(o)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options = &opts
+	s.codecs = newCodecs(s.keyPairs, o.MaxAge)
+}
+
+func (s *serverStore) setKeyPairs(keyPairs [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyPairs = keyPairs
+	s.codecs = newCodecs(keyPairs, s.options.MaxAge)
+}
+
+// settings returns the current options and codecs
+func (s *serverStore) settings() (gsessions.Options, []securecookie.Codec) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return *s.options, s.codecs
+}
+
+func (s *serverStore) Ping() error {
+	return s.backend.ping()
+}
+
+// Get returns the named session, which is only loaded once per request
+func (s *serverStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session from the backend, returning a new session if the
+// cookie is missing or invalid, or the session has expired
+func (s *serverStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts, codecs := s.settings()
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err = securecookie.DecodeMulti(name, c.Value, &session.ID, codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+	data, err := s.backend.load(session.ID)
+	if err != nil || data == nil {
+		session.ID = ""
+		return session, err
+	}
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session to the backend and sets the cookie, or deletes
+// both when the session's MaxAge is negative
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter,
+	session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.backend.save(session.ID, buf.Bytes(), ttl); err != nil {
+		return err
+	}
+	_, codecs := s.settings()
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(
+		securecookie.GenerateRandomKey(32)), "=")
+}
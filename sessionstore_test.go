@@ -0,0 +1,115 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/goincremental/web"
+)
+
+var (
+	testHashKey  = bytes.Repeat([]byte("h"), 32)
+	testBlockKey = bytes.Repeat([]byte("b"), 32)
+)
+
+// saveSession saves a session holding the values with the store, and returns
+// a request carrying the cookies set
+func saveSession(t *testing.T, store web.Store, values map[interface{}]interface{}) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	s, err := store.New(r, "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		s.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, s); err != nil {
+		t.Fatal(err)
+	}
+	next := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		next.AddCookie(c)
+	}
+	return next
+}
+
+func TestStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	for _, opts := range []web.StoreOptions{
+		{Type: web.StoreMemory},
+		{Type: web.StoreCookie},
+		{Type: web.StoreFile, Path: t.TempDir()},
+		{Type: web.StoreRedis, Address: mr.Addr()},
+	} {
+		opts.KeyPairs = [][]byte{testHashKey, testBlockKey}
+		store, err := web.NewStore(opts)
+		if err != nil {
+			t.Fatalf("%s: %v", opts.Type, err)
+		}
+		if p, ok := store.(web.Pinger); ok {
+			if err := p.Ping(); err != nil {
+				t.Errorf("%s: ping: %v", opts.Type, err)
+			}
+		}
+
+		r := saveSession(t, store, map[interface{}]interface{}{"a": "b"})
+		s, err := store.Get(r, "sid")
+		if err != nil || s.IsNew || s.Values["a"] != "b" {
+			t.Errorf("%s: loaded %v, %v", opts.Type, s.Values, err)
+		}
+	}
+}
+
+func TestStoreNeedsKeys(t *testing.T) {
+	if _, err := web.NewStore(web.StoreOptions{Type: web.StoreMemory}); err == nil {
+		t.Error("store created without keys")
+	}
+	_, err := web.NewStore(web.StoreOptions{
+		Type:     web.StoreCookie,
+		KeyPairs: [][]byte{testHashKey},
+	})
+	if err == nil {
+		t.Error("cookie store created without a block key")
+	}
+	_, err = web.NewStore(web.StoreOptions{
+		Type:     web.StoreCookie,
+		KeyPairs: [][]byte{testHashKey, testBlockKey, testHashKey, nil},
+	})
+	if err == nil {
+		t.Error("cookie store created with an old key lacking a block key")
+	}
+}
+
+func TestCookieStoreEncrypts(t *testing.T) {
+	store, err := web.NewStore(web.StoreOptions{
+		Type:     web.StoreCookie,
+		KeyPairs: [][]byte{testHashKey, testBlockKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := saveSession(t, store, map[interface{}]interface{}{"secret": "visible"})
+	c, _ := r.Cookie("sid")
+	if bytes.Contains([]byte(c.Value), []byte("visible")) {
+		t.Error("cookie holds the session in the clear")
+	}
+}
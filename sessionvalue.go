@@ -0,0 +1,223 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNoSession is returned by the typed session accessors when there is no
+// session on the request
+var ErrNoSession = errors.New("web: no session on request")
+
+// ErrNoSessionValue is returned by SessionGet when the session has no value
+// for the key
+var ErrNoSessionValue = errors.New("web: no value in session")
+
+// SessionCodec encodes values of a registered type for storage in the
+// session, so that they come back as the same type whatever the store does
+// to them
+type SessionCodec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type bsonCodec struct{}
+
+func (bsonCodec) Name() string { return "bson" }
+
+// bson can only encode documents, so values are wrapped in one
+func (bsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return bson.Marshal(bson.M{"v": v})
+}
+
+func (bsonCodec) Unmarshal(data []byte, v interface{}) error {
+	var doc struct {
+		V bson.Raw `bson:"v"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return doc.V.Unmarshal(v)
+}
+
+// Codecs which can be registered for session values
+var (
+	JSONCodec SessionCodec = jsonCodec{}
+	GobCodec  SessionCodec = gobCodec{}
+	BSONCodec SessionCodec = bsonCodec{}
+)
+
+var (
+	sessionCodecsMu sync.RWMutex
+	sessionCodecs   = map[reflect.Type]SessionCodec{}
+)
+
+// RegisterSessionType registers the codec used to store values of type T in
+// the session with SessionSet and SessionGet.  Types which are not
+// registered are stored as they are, so should be basic types that every
+// store can keep.
+func RegisterSessionType[T any](codec SessionCodec) {
+	sessionCodecsMu.Lock()
+	defer sessionCodecsMu.Unlock()
+	sessionCodecs[reflect.TypeOf((*T)(nil)).Elem()] = codec
+}
+
+func sessionCodec(t reflect.Type) SessionCodec {
+	sessionCodecsMu.RLock()
+	defer sessionCodecsMu.RUnlock()
+	return sessionCodecs[t]
+}
+
+// SessionSet stores val in the session on the request, encoded with the
+// codec registered for T if there is one
+func SessionSet[T any](r *http.Request, key string, val T) error {
+	s := GetSession(r)
+	if s == nil {
+		return ErrNoSession
+	}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	codec := sessionCodec(t)
+	if codec == nil {
+		s.Set(key, val)
+		return nil
+	}
+	data, err := codec.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("web: unable to encode session value %q as %s: %v",
+			key, codec.Name(), err)
+	}
+	s.Set(key, codec.Name()+":"+base64.StdEncoding.EncodeToString(data))
+	return nil
+}
+
+// SessionGet retrieves a value of type T from the session on the request.
+// It returns ErrNoSessionValue if the key is not set, and an error naming
+// the key and types involved if the value cannot be decoded as a T.
+func SessionGet[T any](r *http.Request, key string) (T, error) {
+	var result T
+	s := GetSession(r)
+	if s == nil {
+		return result, ErrNoSession
+	}
+	v := s.Get(key)
+	if v == nil {
+		return result, ErrNoSessionValue
+	}
+
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	codec := sessionCodec(t)
+	if codec == nil {
+		if converted, ok := convertSessionValue(v, t); ok {
+			return converted.(T), nil
+		}
+		return result, fmt.Errorf("web: session value %q is a %T, not a %v",
+			key, v, t)
+	}
+
+	str, ok := v.(string)
+	name, encoded, found := strings.Cut(str, ":")
+	if !ok || !found {
+		return result, fmt.Errorf("web: session value %q is a %T, not an encoded %v",
+			key, v, t)
+	}
+	if name != codec.Name() {
+		return result, fmt.Errorf("web: session value %q was encoded as %s, but %v is registered as %s",
+			key, name, t, codec.Name())
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil {
+		err = codec.Unmarshal(data, &result)
+	}
+	if err != nil {
+		return result, fmt.Errorf("web: unable to decode session value %q as %v: %v",
+			key, t, err)
+	}
+	return result, nil
+}
+
+// convertSessionValue converts v to t, allowing for stores which change the
+// type of numbers, such as bson turning an int into an int64.  Numbers which
+// t cannot hold exactly, such as 300 as an int8 or 1.5 as an int, are not
+// converted.
+func convertSessionValue(v interface{}, t reflect.Type) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(t) {
+		return v, true
+	}
+	if !isNumericKind(rv.Kind()) || !isNumericKind(t.Kind()) {
+		return nil, false
+	}
+	converted := rv.Convert(t)
+	if converted.Convert(rv.Type()).Interface() != v ||
+		isNegative(converted) != isNegative(rv) {
+		return nil, false
+	}
+	return converted.Interface(), true
+}
+
+// isNegative reports whether a number is below zero, which catches the
+// conversions between signed and unsigned numbers that survive a round trip
+func isNegative(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() < 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() < 0
+	}
+	return false
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
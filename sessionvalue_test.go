@@ -0,0 +1,166 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/goincremental/web"
+)
+
+type cart struct {
+	Items []string
+	Total float64
+}
+
+// each codec is registered for its own type, as registrations are global
+type (
+	jsonCart cart
+	gobCart  cart
+	bsonCart cart
+)
+
+func init() {
+	web.RegisterSessionType[jsonCart](web.JSONCodec)
+	web.RegisterSessionType[gobCart](web.GobCodec)
+	web.RegisterSessionType[bsonCart](web.BSONCodec)
+}
+
+// sessionValueServer sets the value in the session on /set and writes what
+// SessionGet returns on /get, storing sessions in a cookie
+func sessionValueServer[T any](t *testing.T, val T) http.Handler {
+	store, err := web.NewStore(web.StoreOptions{
+		Type:     web.StoreCookie,
+		KeyPairs: [][]byte{testHashKey, testBlockKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := web.NewRouter()
+	r.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		if err := web.SessionSet(r, "v", val); err != nil {
+			t.Error(err)
+		}
+		web.GetSession(r).Set("n", 3)
+	})
+	r.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		got, err := web.SessionGet[T](r, "v")
+		if err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(got, val) {
+			t.Errorf("got %+v, want %+v", got, val)
+		}
+		n, err := web.SessionGet[int64](r, "n")
+		if err != nil || n != 3 {
+			t.Errorf("number %v: %v", n, err)
+		}
+		if _, err := web.SessionGet[string](r, "n"); err == nil {
+			t.Error("number returned as a string")
+		}
+		if _, err := web.SessionGet[T](r, "missing"); !errors.Is(err, web.ErrNoSessionValue) {
+			t.Errorf("missing value: %v", err)
+		}
+	})
+	s := web.NewServer()
+	s.Use(web.Sessions("sid", store))
+	s.UseHandler(r)
+	return s
+}
+
+func TestSessionValues(t *testing.T) {
+	for _, h := range []http.Handler{
+		sessionValueServer(t, jsonCart{Items: []string{"a"}, Total: 2.5}),
+		sessionValueServer(t, gobCart{Items: []string{"a"}, Total: 2.5}),
+		sessionValueServer(t, bsonCart{Items: []string{"a"}, Total: 2.5}),
+	} {
+		c := newSessionClient(t, h)
+		c.get("/set")
+		c.get("/get")
+	}
+}
+
+// A value stored with one codec is not decoded with another
+func TestSessionValueWrongCodec(t *testing.T) {
+	store, _ := web.NewStore(web.StoreOptions{Type: web.StoreMemory, KeyPairs: [][]byte{testHashKey}})
+	var err error
+	r := web.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		web.SessionSet(r, "v", jsonCart{Total: 1})
+		_, err = web.SessionGet[gobCart](r, "v")
+	})
+	s := web.NewServer()
+	s.Use(web.Sessions("sid", store))
+	s.UseHandler(r)
+	newSessionClient(t, s).get("/")
+	if err == nil {
+		t.Error("value decoded with another codec")
+	}
+}
+
+// sessionGetAs returns SessionGet for T, so that values of several types
+// can be read in one table
+func sessionGetAs[T any]() func(r *http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		return web.SessionGet[T](r, "v")
+	}
+}
+
+// Stores may change the type of numbers, which are converted back only when
+// no information is lost
+func TestSessionValueNumbers(t *testing.T) {
+	store, _ := web.NewStore(web.StoreOptions{Type: web.StoreMemory, KeyPairs: [][]byte{testHashKey}})
+	for _, test := range []struct {
+		stored interface{}
+		get    func(r *http.Request) (interface{}, error)
+		want   interface{}
+	}{
+		{int64(3), sessionGetAs[int](), 3},
+		{int64(-3), sessionGetAs[int8](), int8(-3)},
+		{int32(200), sessionGetAs[uint8](), uint8(200)},
+		{float64(2), sessionGetAs[int](), 2},
+		{3, sessionGetAs[float64](), float64(3)},
+		{float64(0.5), sessionGetAs[float32](), float32(0.5)},
+		{int64(300), sessionGetAs[int8](), nil},
+		{int64(-1), sessionGetAs[uint](), nil},
+		{uint64(math.MaxUint64), sessionGetAs[int64](), nil},
+		{float64(1.5), sessionGetAs[int](), nil},
+		{float64(1e300), sessionGetAs[int64](), nil},
+		{float64(0.1), sessionGetAs[float32](), nil},
+		{int64(1<<53 + 1), sessionGetAs[float64](), nil},
+		{"3", sessionGetAs[int](), nil},
+	} {
+		var got interface{}
+		var err error
+		s := web.NewServer()
+		s.Use(web.Sessions("sid", store))
+		s.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			web.GetSession(r).Set("v", test.stored)
+			got, err = test.get(r)
+		}))
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%T %v read as %T %v", test.stored, test.stored, got, got)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("%T %v read as %T %v: %v", test.stored, test.stored, got, got, err)
+		}
+	}
+}
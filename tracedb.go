@@ -0,0 +1,147 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/goincremental/dal"
+)
+
+// tracedDatabase wraps the database returned by GetDb when the request is
+// being traced, so that each call to the database is recorded as a span
+type tracedDatabase struct {
+	dal.Database
+	r *http.Request
+}
+
+func (d *tracedDatabase) C(name string) dal.Collection {
+	return &tracedCollection{Collection: d.Database.C(name), r: d.r, name: name}
+}
+
+type tracedCollection struct {
+	dal.Collection
+	r    *http.Request
+	name string
+}
+
+func (c *tracedCollection) span(op string) Span {
+	s := StartSpan(c.r, "dal "+c.name+"."+op)
+	s.SetAttribute("db.collection", c.name)
+	s.SetAttribute("db.operation", op)
+	return s
+}
+
+func (c *tracedCollection) Find(q dal.Q) dal.Query {
+	return &tracedQuery{Query: c.Collection.Find(q), c: c, op: "find"}
+}
+
+func (c *tracedCollection) FindID(id interface{}) dal.Query {
+	return &tracedQuery{Query: c.Collection.FindID(id), c: c, op: "findId"}
+}
+
+func (c *tracedCollection) EnsureIndex(index dal.Index) error {
+	s := c.span("ensureIndex")
+	defer s.End()
+	err := c.Collection.EnsureIndex(index)
+	s.SetError(err)
+	return err
+}
+
+func (c *tracedCollection) Insert(docs ...interface{}) error {
+	s := c.span("insert")
+	defer s.End()
+	err := c.Collection.Insert(docs...)
+	s.SetError(err)
+	return err
+}
+
+func (c *tracedCollection) Update(selector interface{}, update interface{}) error {
+	s := c.span("update")
+	defer s.End()
+	err := c.Collection.Update(selector, update)
+	s.SetError(err)
+	return err
+}
+
+func (c *tracedCollection) UpsertID(id interface{},
+	update interface{}) (*dal.ChangeInfo, error) {
+	s := c.span("upsertId")
+	defer s.End()
+	info, err := c.Collection.UpsertID(id, update)
+	s.SetError(err)
+	return info, err
+}
+
+func (c *tracedCollection) RemoveID(id interface{}) error {
+	s := c.span("removeId")
+	defer s.End()
+	err := c.Collection.RemoveID(id)
+	s.SetError(err)
+	return err
+}
+
+func (c *tracedCollection) RemoveAll(selector interface{}) (*dal.ChangeInfo, error) {
+	s := c.span("removeAll")
+	defer s.End()
+	info, err := c.Collection.RemoveAll(selector)
+	s.SetError(err)
+	return info, err
+}
+
+// tracedQuery records the span when the query is executed, rather than when
+// it is built.  The methods which refine the query return a tracedQuery, so
+// that the span is still recorded however the query is built.
+type tracedQuery struct {
+	dal.Query
+	c  *tracedCollection
+	op string
+}
+
+func (q *tracedQuery) Sort(fields ...string) dal.Query {
+	return &tracedQuery{Query: q.Query.Sort(fields...), c: q.c, op: q.op}
+}
+
+func (q *tracedQuery) Skip(n int) dal.Query {
+	return &tracedQuery{Query: q.Query.Skip(n), c: q.c, op: q.op}
+}
+
+func (q *tracedQuery) Limit(n int) dal.Query {
+	return &tracedQuery{Query: q.Query.Limit(n), c: q.c, op: q.op}
+}
+
+func (q *tracedQuery) Count() (int, error) {
+	s := q.c.span(q.op + ".count")
+	defer s.End()
+	n, err := q.Query.Count()
+	s.SetError(err)
+	return n, err
+}
+
+func (q *tracedQuery) One(result interface{}) error {
+	s := q.c.span(q.op + ".one")
+	defer s.End()
+	err := q.Query.One(result)
+	s.SetError(err)
+	return err
+}
+
+func (q *tracedQuery) All(result interface{}) error {
+	s := q.c.span(q.op + ".all")
+	defer s.End()
+	err := q.Query.All(result)
+	s.SetError(err)
+	return err
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/webtest"
+)
+
+func TestTracedDatabase(t *testing.T) {
+	exp := web.NewMemoryExporter()
+	tracer := web.NewTracer("svc", exp)
+	r := httptest.NewRequest("GET", "/", nil)
+	web.SetDb(r, webtest.NewDatabase())
+
+	tracer.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+		things := (*web.GetDb(r)).C("things")
+		things.Insert(dal.BSON{"_id": "a"}, dal.BSON{"_id": "b"})
+		var all []dal.BSON
+		things.Find(nil).Sort("_id").Skip(1).Limit(1).All(&all)
+		things.Find(nil).Count()
+		things.Update(dal.Q{"_id": "a"}, dal.Q{"$set": dal.Q{"n": 1}})
+		things.RemoveAll(dal.Q{})
+	})
+
+	var names []string
+	for _, s := range exp.Spans() {
+		names = append(names, s.Name)
+	}
+	want := []string{
+		"dal things.insert",
+		"dal things.find.all",
+		"dal things.find.count",
+		"dal things.update",
+		"dal things.removeAll",
+		"GET /",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("spans %q, want %q", names, want)
+	}
+}
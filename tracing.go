@@ -0,0 +1,368 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/negroni"
+)
+
+const traceParentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace, and is what is propagated
+// between services in the W3C traceparent header
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+// Valid reports whether the span context has both a trace and span id
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// TraceParent formats the span context as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// ParseTraceParent parses a W3C traceparent header value
+func ParseTraceParent(s string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, fmt.Errorf("Malformed traceparent: %q", s)
+	}
+	// version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, fmt.Errorf("Malformed traceparent: %q", s)
+	}
+	traceID, spanID, flags := parts[1], parts[2], parts[3]
+	if !isHexID(traceID, 32) || !isHexID(spanID, 16) || len(flags) != 2 {
+		return SpanContext{}, fmt.Errorf("Malformed traceparent: %q", s)
+	}
+	f, err := hex.DecodeString(flags)
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("Malformed traceparent: %v", err)
+	}
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: f[0]&1 == 1}, nil
+}
+
+// isHexID checks the id is lower case hex of the given length, and not all
+// zeros, which the W3C spec reserves as invalid
+func isHexID(id string, length int) bool {
+	if len(id) != length || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SpanData is the record of a finished span which is handed to an Exporter
+type SpanData struct {
+	Service      string                 `json:"service"`
+	Name         string                 `json:"name"`
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Duration returns how long the span took
+func (s SpanData) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Span is a single timed operation within a trace
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value interface{})
+	SetError(err error)
+	End()
+}
+
+type span struct {
+	tracer  *tracer
+	sampled bool
+	mu      sync.Mutex
+	data    SpanData
+	ended   bool
+}
+
+func (s *span) Context() SpanContext {
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID, Sampled: s.sampled}
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = map[string]interface{}{}
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.sampled {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+// noopSpan is returned when there is no trace in progress, so that callers
+// can always defer End
+type noopSpan struct{}
+
+func (noopSpan) Context() SpanContext                       { return SpanContext{} }
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) End()                                       {}
+
+// Exporter receives every sampled span once it has ended
+type Exporter interface {
+	Export(span SpanData)
+}
+
+// Tracer is middleware that starts a span for each request, continuing the
+// trace of the caller when a traceparent header is present.  Spans for the
+// matched route, database calls made through GetDb and outbound requests made
+// through TraceTransport are recorded as children of the request span.
+type Tracer interface {
+	Middleware
+	StartSpan(name string, parent SpanContext) Span
+}
+
+type tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// StartSpan starts a new span, which is a child of parent if it is valid and
+// the root of a new trace otherwise
+func (t *tracer) StartSpan(name string, parent SpanContext) Span {
+	return t.start(name, parent)
+}
+
+func (t *tracer) start(name string, parent SpanContext) *span {
+	s := &span{tracer: t, sampled: true}
+	s.data = SpanData{
+		Service: t.service,
+		Name:    name,
+		SpanID:  newID(8),
+		Start:   time.Now(),
+	}
+	if parent.Valid() {
+		s.data.TraceID = parent.TraceID
+		s.data.ParentSpanID = parent.SpanID
+		s.sampled = parent.Sampled
+	} else {
+		s.data.TraceID = newID(16)
+	}
+	return s
+}
+
+func (t *tracer) ServeHTTP(rw http.ResponseWriter, r *http.Request,
+	next http.HandlerFunc) {
+	parent, _ := ParseTraceParent(r.Header.Get(traceParentHeader))
+	s := t.start(r.Method+" "+r.URL.Path, parent)
+	s.SetAttribute("http.method", r.Method)
+	s.SetAttribute("http.target", r.URL.RequestURI())
+	defer s.End()
+
+	res, ok := rw.(negroni.ResponseWriter)
+	if !ok {
+		res = negroni.NewResponseWriter(rw)
+	}
+	spanKey.Set(r, s)
+
+	next(res, r)
+
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	s.SetAttribute("http.status_code", status)
+	if status >= http.StatusInternalServerError {
+		s.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+}
+
+// NewTracer creates a Tracer which labels its spans with the service name and
+// hands them to the exporter when they end
+func NewTracer(service string, exporter Exporter) Tracer {
+	return &tracer{service: service, exporter: exporter}
+}
+
+var spanKey = NewKey[Span]("span")
+
+// GetSpan retrieves the current span from the request context
+func GetSpan(r *http.Request) Span {
+	rv, _ := spanKey.Get(r)
+	return rv
+}
+
+// StartSpan starts a child of the current span on the request.  If the
+// request is not being traced a span which records nothing is returned.
+func StartSpan(r *http.Request, name string) Span {
+	if parent, ok := GetSpan(r).(*span); ok {
+		return parent.tracer.start(name, parent.Context())
+	}
+	return noopSpan{}
+}
+
+// withSpan makes s the current span on the request while f runs
+func withSpan(r *http.Request, s Span, f func()) {
+	parent := GetSpan(r)
+	spanKey.Set(r, s)
+	defer spanKey.Set(r, parent)
+	f()
+}
+
+type traceTransport struct {
+	r    *http.Request
+	base http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := StartSpan(t.r, req.Method+" "+req.URL.Host)
+	defer s.End()
+	s.SetAttribute("http.method", req.Method)
+	s.SetAttribute("http.url", req.URL.String())
+
+	out := req
+	if sc := s.Context(); sc.Valid() {
+		// RoundTrippers must not modify the request they are given
+		out = req.Clone(req.Context())
+		out.Header.Set(traceParentHeader, sc.TraceParent())
+	}
+	res, err := t.base.RoundTrip(out)
+	if err != nil {
+		s.SetError(err)
+		return nil, err
+	}
+	s.SetAttribute("http.status_code", res.StatusCode)
+	return res, nil
+}
+
+// TraceTransport returns a RoundTripper which records outbound requests as
+// children of the current span on r, and propagates the trace to the called
+// service.  If base is nil http.DefaultTransport is used.
+func TraceTransport(r *http.Request, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &traceTransport{r: r, base: base}
+}
+
+// MemoryExporter keeps finished spans in memory, and is intended for tests
+type MemoryExporter interface {
+	Exporter
+	Spans() []SpanData
+	Reset()
+}
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *memoryExporter) Export(s SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func (e *memoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+func (e *memoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// NewMemoryExporter creates an exporter that records spans in memory
+func NewMemoryExporter() MemoryExporter {
+	return &memoryExporter{}
+}
+
+type writerExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *writerExporter) Export(s SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := json.NewEncoder(e.w).Encode(s); err != nil {
+		log.Printf("Unable to export span: %v", err)
+	}
+}
+
+// NewWriterExporter creates an exporter that writes each span to w as a line
+// of JSON.  Passing os.Stdout gives a simple exporter for development.
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w}
+}
@@ -0,0 +1,879 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webtest provides helpers for testing applications built with the
+// web package without any external services.
+package webtest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrDuplicateKey is returned when inserting a document whose _id is already
+// present in the collection
+var ErrDuplicateKey = errors.New("E11000 duplicate key error")
+
+// store holds the collections of every database on a connection, and is
+// shared between the connection and all of its clones
+type store struct {
+	mu  sync.Mutex
+	dbs map[string]map[string]*collectionData
+}
+
+type collectionData struct {
+	docs []bson.M
+}
+
+func (s *store) collection(db, name string) *collectionData {
+	cols, ok := s.dbs[db]
+	if !ok {
+		cols = map[string]*collectionData{}
+		s.dbs[db] = cols
+	}
+	col, ok := cols[name]
+	if !ok {
+		col = &collectionData{}
+		cols[name] = col
+	}
+	return col
+}
+
+type connection struct {
+	store         *store
+	transactional bool
+}
+
+// NewConnection creates an empty in-memory dal.Connection.  Clones of the
+// connection share its data, as clones of a real connection share a server.
+// Like the real dal its databases do not support transactions, so
+// web.WithTransaction runs without one.
+func NewConnection() dal.Connection {
+	return &connection{store: &store{dbs: map[string]map[string]*collectionData{}}}
+}
+
+// NewTransactionalConnection creates an empty in-memory dal.Connection whose
+// databases implement web.Transactional, for testing code against a
+// database which supports transactions
+func NewTransactionalConnection() dal.Connection {
+	c := NewConnection().(*connection)
+	c.transactional = true
+	return c
+}
+
+// NewDatabase creates an empty in-memory dal.Database
+func NewDatabase() dal.Database {
+	return NewConnection().DB("test")
+}
+
+// NewTransactionalDatabase creates an empty in-memory dal.Database which
+// implements web.Transactional
+func NewTransactionalDatabase() dal.Database {
+	return NewTransactionalConnection().DB("test")
+}
+
+func (c *connection) Clone() dal.Connection {
+	return &connection{store: c.store, transactional: c.transactional}
+}
+
+func (c *connection) Close() {}
+
+func (c *connection) Ping() error {
+	return nil
+}
+
+func (c *connection) DB(name string) dal.Database {
+	d := &database{store: c.store, name: name}
+	if c.transactional {
+		return &transactionalDatabase{d}
+	}
+	return d
+}
+
+type database struct {
+	store *store
+	name  string
+}
+
+func (d *database) C(name string) dal.Collection {
+	return &collection{db: d, name: name}
+}
+
+// transactionalDatabase is a database which implements web.Transactional
+type transactionalDatabase struct {
+	*database
+}
+
+// Begin starts a transaction on a snapshot of the database, so that the
+// fake can stand in for databases used with web.WithTransaction
+func (d *transactionalDatabase) Begin() (web.Transaction, error) {
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	base := map[string]*collectionData{}
+	snapshot := &store{dbs: map[string]map[string]*collectionData{}}
+	for name, col := range d.store.dbs[d.name] {
+		base[name] = &collectionData{}
+		copied := snapshot.collection(d.name, name)
+		for _, doc := range col.docs {
+			base[name].docs = append(base[name].docs, copyDoc(doc))
+			copied.docs = append(copied.docs, copyDoc(doc))
+		}
+	}
+	return &transaction{db: d.database, base: base, snapshot: snapshot}, nil
+}
+
+// transaction works on a snapshot of the database, keeping the collections
+// as they were when it began so that Commit can tell what it changed
+type transaction struct {
+	db       *database
+	base     map[string]*collectionData
+	snapshot *store
+}
+
+func (t *transaction) DB() dal.Database {
+	return &database{store: t.snapshot, name: t.db.name}
+}
+
+// Commit applies the documents the transaction inserted, changed or removed
+// to the database, leaving the documents it did not touch as they are now,
+// so that writes made outside the transaction are kept
+func (t *transaction) Commit() error {
+	t.db.store.mu.Lock()
+	defer t.db.store.mu.Unlock()
+	t.snapshot.mu.Lock()
+	defer t.snapshot.mu.Unlock()
+	for name, col := range t.snapshot.dbs[t.db.name] {
+		base, ok := t.base[name]
+		if !ok {
+			base = &collectionData{}
+		}
+		live := t.db.store.collection(t.db.name, name)
+		for _, doc := range base.docs {
+			if col.index(doc["_id"]) < 0 {
+				live.remove(doc["_id"])
+			}
+		}
+		for _, doc := range col.docs {
+			if i := base.index(doc["_id"]); i >= 0 && reflect.DeepEqual(base.docs[i], doc) {
+				continue
+			}
+			live.put(copyDoc(doc))
+		}
+	}
+	return nil
+}
+
+func (t *transaction) Rollback() error {
+	return nil
+}
+
+type collection struct {
+	db   *database
+	name string
+}
+
+// with runs f with the collection's data while holding the store's lock
+func (c *collection) with(f func(col *collectionData) error) error {
+	c.db.store.mu.Lock()
+	defer c.db.store.mu.Unlock()
+	return f(c.db.store.collection(c.db.name, c.name))
+}
+
+func (c *collection) Find(q dal.Q) dal.Query {
+	selector, err := toSelector(q)
+	return &query{c: c, selector: selector, err: err}
+}
+
+func (c *collection) FindID(id interface{}) dal.Query {
+	return c.Find(dal.Q{"_id": id})
+}
+
+func (c *collection) EnsureIndex(index dal.Index) error {
+	return nil
+}
+
+func (c *collection) Insert(docs ...interface{}) error {
+	return c.with(func(col *collectionData) error {
+		for _, d := range docs {
+			doc, err := toDoc(d)
+			if err != nil {
+				return err
+			}
+			id, ok := doc["_id"]
+			if !ok || id == nil || id == "" {
+				doc["_id"] = dal.NewObjectID()
+				if doc, err = toDoc(doc); err != nil {
+					return err
+				}
+			}
+			if col.index(doc["_id"]) >= 0 {
+				return ErrDuplicateKey
+			}
+			col.docs = append(col.docs, doc)
+		}
+		return nil
+	})
+}
+
+func (c *collection) RemoveID(id interface{}) error {
+	key, err := normalize(id)
+	if err != nil {
+		return err
+	}
+	return c.with(func(col *collectionData) error {
+		i := col.index(key)
+		if i < 0 {
+			return dal.ErrNotFound
+		}
+		col.docs = append(col.docs[:i], col.docs[i+1:]...)
+		return nil
+	})
+}
+
+func (c *collection) RemoveAll(selector interface{}) (*dal.ChangeInfo, error) {
+	sel, err := toSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	info := &dal.ChangeInfo{}
+	err = c.with(func(col *collectionData) error {
+		kept := col.docs[:0]
+		for _, doc := range col.docs {
+			if matches(doc, sel) {
+				info.Removed++
+				continue
+			}
+			kept = append(kept, doc)
+		}
+		col.docs = kept
+		return nil
+	})
+	return info, err
+}
+
+func (c *collection) UpsertID(id interface{},
+	update interface{}) (*dal.ChangeInfo, error) {
+	key, err := normalize(id)
+	if err != nil {
+		return nil, err
+	}
+	upd, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	info := &dal.ChangeInfo{}
+	err = c.with(func(col *collectionData) error {
+		i := col.index(key)
+		var doc bson.M
+		if i >= 0 {
+			doc = col.docs[i]
+		}
+		doc, err := applyUpdate(doc, upd)
+		if err != nil {
+			return err
+		}
+		doc["_id"] = key
+		if i >= 0 {
+			col.docs[i] = doc
+			info.Updated = 1
+		} else {
+			col.docs = append(col.docs, doc)
+			info.UpsertedId = key
+		}
+		return nil
+	})
+	return info, err
+}
+
+// Update applies the update to the first document matching the selector,
+// returning dal.ErrNotFound if there is none
+func (c *collection) Update(selector interface{}, update interface{}) error {
+	sel, err := toSelector(selector)
+	if err != nil {
+		return err
+	}
+	upd, err := toDoc(update)
+	if err != nil {
+		return err
+	}
+	return c.with(func(col *collectionData) error {
+		for i, doc := range col.docs {
+			if !matches(doc, sel) {
+				continue
+			}
+			updated, err := applyUpdate(doc, upd)
+			if err != nil {
+				return err
+			}
+			updated["_id"] = doc["_id"]
+			col.docs[i] = updated
+			return nil
+		}
+		return dal.ErrNotFound
+	})
+}
+
+func (col *collectionData) index(id interface{}) int {
+	for i, doc := range col.docs {
+		if equal(doc["_id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// put replaces the document with the same _id, or adds it if there is none
+func (col *collectionData) put(doc bson.M) {
+	if i := col.index(doc["_id"]); i >= 0 {
+		col.docs[i] = doc
+		return
+	}
+	col.docs = append(col.docs, doc)
+}
+
+func (col *collectionData) remove(id interface{}) {
+	if i := col.index(id); i >= 0 {
+		col.docs = append(col.docs[:i], col.docs[i+1:]...)
+	}
+}
+
+type query struct {
+	c        *collection
+	selector bson.M
+	sort     []string
+	skip     int
+	limit    int
+	err      error
+}
+
+func (q *query) Sort(fields ...string) dal.Query {
+	q.sort = fields
+	return q
+}
+
+func (q *query) Skip(n int) dal.Query {
+	q.skip = n
+	return q
+}
+
+func (q *query) Limit(n int) dal.Query {
+	q.limit = n
+	return q
+}
+
+func (q *query) Count() (int, error) {
+	docs, err := q.run()
+	return len(docs), err
+}
+
+func (q *query) One(result interface{}) error {
+	docs, err := q.run()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return dal.ErrNotFound
+	}
+	return fromDoc(docs[0], result)
+}
+
+func (q *query) All(result interface{}) error {
+	docs, err := q.run()
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("webtest: All needs a pointer to a slice, not %T", result)
+	}
+	slice := v.Elem()
+	slice.Set(slice.Slice(0, 0))
+	for _, doc := range docs {
+		elem := reflect.New(slice.Type().Elem())
+		if err := fromDoc(doc, elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return nil
+}
+
+// run returns copies of the matching documents, sorted and paged
+func (q *query) run() ([]bson.M, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	var docs []bson.M
+	err := q.c.with(func(col *collectionData) error {
+		for _, doc := range col.docs {
+			if matches(doc, q.selector) {
+				docs = append(docs, copyDoc(doc))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(q.sort) > 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			return less(docs[i], docs[j], q.sort)
+		})
+	}
+	if q.skip > 0 {
+		if q.skip > len(docs) {
+			q.skip = len(docs)
+		}
+		docs = docs[q.skip:]
+	}
+	if q.limit > 0 && q.limit < len(docs) {
+		docs = docs[:q.limit]
+	}
+	return docs, nil
+}
+
+func less(a, b bson.M, fields []string) bool {
+	for _, f := range fields {
+		desc := strings.HasPrefix(f, "-")
+		f = strings.TrimPrefix(strings.TrimPrefix(f, "-"), "+")
+		av, _ := lookup(a, f)
+		bv, _ := lookup(b, f)
+		c, ok := compare(av, bv)
+		if !ok || c == 0 {
+			continue
+		}
+		return (c < 0) != desc
+	}
+	return false
+}
+
+// toDoc converts a struct or map to a document using its bson tags, in the
+// same form the document would take after a round trip through mongodb
+func toDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// toSelector converts a query to a document, returning an error if it uses
+// an operator the fake does not support rather than matching it wrongly
+func toSelector(v interface{}) (bson.M, error) {
+	sel, err := toDoc(v)
+	if err != nil {
+		return nil, err
+	}
+	return sel, checkSelector(sel)
+}
+
+func checkSelector(selector bson.M) error {
+	for k, cond := range selector {
+		switch k {
+		case "$and", "$or", "$nor":
+			list, ok := cond.([]interface{})
+			if !ok {
+				return fmt.Errorf("webtest: %s needs an array", k)
+			}
+			for _, c := range list {
+				sub, ok := c.(bson.M)
+				if !ok {
+					return fmt.Errorf("webtest: %s needs documents", k)
+				}
+				if err := checkSelector(sub); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "$") {
+			return fmt.Errorf("webtest: unsupported query operator %s", k)
+		}
+		if err := checkCondition(cond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCondition checks the condition on a single field
+func checkCondition(cond interface{}) error {
+	ops, ok := cond.(bson.M)
+	if !ok || !isOperators(ops) {
+		return nil
+	}
+	for op, arg := range ops {
+		switch op {
+		case "$eq", "$ne":
+			if err := checkCondition(arg); err != nil {
+				return err
+			}
+		case "$in", "$nin":
+			if _, ok := arg.([]interface{}); !ok {
+				return fmt.Errorf("webtest: %s needs an array", op)
+			}
+		case "$exists", "$gt", "$gte", "$lt", "$lte":
+		default:
+			return fmt.Errorf("webtest: unsupported query operator %s", op)
+		}
+	}
+	return nil
+}
+
+func fromDoc(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// normalize converts a single value, such as an id or a pointer to one, to
+// the form it would have in a stored document
+func normalize(v interface{}) (interface{}, error) {
+	doc, err := toDoc(bson.M{"v": v})
+	if err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+func copyDoc(doc bson.M) bson.M {
+	copied, err := toDoc(doc)
+	if err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+func applyUpdate(doc bson.M, update bson.M) (bson.M, error) {
+	operators := false
+	for k := range update {
+		if strings.HasPrefix(k, "$") {
+			operators = true
+			break
+		}
+	}
+	if !operators {
+		return copyDoc(update), nil
+	}
+	if doc == nil {
+		doc = bson.M{}
+	} else {
+		doc = copyDoc(doc)
+	}
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("webtest: %s needs a document", op)
+		}
+		for path, v := range fields {
+			switch op {
+			case "$set", "$setOnInsert":
+				set(doc, path, v)
+			case "$unset":
+				unset(doc, path)
+			case "$inc":
+				cur, _ := lookup(doc, path)
+				set(doc, path, toFloat(cur)+toFloat(v))
+			case "$push":
+				cur, _ := lookup(doc, path)
+				list, _ := cur.([]interface{})
+				set(doc, path, append(list, v))
+			case "$pull":
+				if err := checkPull(v); err != nil {
+					return nil, err
+				}
+				cur, _ := lookup(doc, path)
+				list, _ := cur.([]interface{})
+				kept := []interface{}{}
+				for _, elem := range list {
+					if !pullMatches(elem, v) {
+						kept = append(kept, elem)
+					}
+				}
+				set(doc, path, kept)
+			default:
+				return nil, fmt.Errorf("webtest: unsupported update operator %s", op)
+			}
+		}
+	}
+	return doc, nil
+}
+
+// pullMatches reports whether an array element is removed by a $pull
+// condition, which is either a value or a query on embedded documents
+func pullMatches(elem, cond interface{}) bool {
+	if c, ok := cond.(bson.M); ok && !isOperators(c) {
+		doc, ok := elem.(bson.M)
+		return ok && matches(doc, c)
+	}
+	return matchValue(elem, true, cond)
+}
+
+// checkPull checks a $pull condition, as pullMatches reads it
+func checkPull(cond interface{}) error {
+	if c, ok := cond.(bson.M); ok && !isOperators(c) {
+		return checkSelector(c)
+	}
+	return checkCondition(cond)
+}
+
+func set(doc bson.M, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := doc[p].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[p] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = v
+}
+
+func unset(doc bson.M, path string) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := doc[p].(bson.M)
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, parts[len(parts)-1])
+}
+
+// lookup finds the values at a dotted path.  Where the path passes through
+// an array every element is followed, so "userIds.providerId" finds the
+// providerId of each entry in userIds, as mongodb does.
+func lookup(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	head, rest := path, ""
+	if i := strings.Index(path, "."); i >= 0 {
+		head, rest = path[:i], path[i+1:]
+	}
+	switch t := v.(type) {
+	case bson.M:
+		next, ok := t[head]
+		if !ok {
+			return nil, false
+		}
+		return lookup(next, rest)
+	case []interface{}:
+		var found []interface{}
+		for _, elem := range t {
+			if r, ok := lookup(elem, path); ok {
+				found = append(found, r)
+			}
+		}
+		return found, len(found) > 0
+	}
+	return nil, false
+}
+
+func matches(doc bson.M, selector bson.M) bool {
+	for k, cond := range selector {
+		switch k {
+		case "$and", "$or", "$nor":
+			list, _ := cond.([]interface{})
+			n := 0
+			for _, c := range list {
+				if sub, ok := c.(bson.M); ok && matches(doc, sub) {
+					n++
+				}
+			}
+			if k == "$and" && n != len(list) || k == "$or" && n == 0 ||
+				k == "$nor" && n > 0 {
+				return false
+			}
+			continue
+		}
+		v, found := lookup(doc, k)
+		if !matchValue(v, found, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchValue(v interface{}, found bool, cond interface{}) bool {
+	if ops, ok := cond.(bson.M); ok && isOperators(ops) {
+		for op, arg := range ops {
+			if !matchOperator(v, found, op, arg) {
+				return false
+			}
+		}
+		return true
+	}
+	return found && anyElem(v, func(e interface{}) bool { return equal(e, cond) }) ||
+		!found && cond == nil
+}
+
+func isOperators(m bson.M) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func matchOperator(v interface{}, found bool, op string, arg interface{}) bool {
+	switch op {
+	case "$eq":
+		return matchValue(v, found, arg)
+	case "$ne":
+		return !matchValue(v, found, arg)
+	case "$exists":
+		b, _ := arg.(bool)
+		return found == b
+	case "$in", "$nin":
+		list, _ := arg.([]interface{})
+		in := false
+		for _, a := range list {
+			if matchValue(v, found, a) {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in")
+	case "$gt", "$gte", "$lt", "$lte":
+		return found && anyElem(v, func(e interface{}) bool {
+			c, ok := compare(e, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		})
+	}
+	// unreachable, as selectors are checked by toSelector
+	return false
+}
+
+// anyElem applies f to v, or to each element of v if it is an array, as
+// mongodb does when matching against array fields
+func anyElem(v interface{}, f func(interface{}) bool) bool {
+	if f(v) {
+		return true
+	}
+	if list, ok := v.([]interface{}); ok {
+		for _, e := range list {
+			if anyElem(e, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// compare orders two values of the same kind, reporting false when they
+// cannot be compared
+func compare(a, b interface{}) (int, bool) {
+	switch {
+	case isNumber(a) && isNumber(b):
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bson.ObjectId:
+		if y, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(x), string(y)), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case !x:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,168 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webtest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+)
+
+type item struct {
+	ID   string   `bson:"_id"`
+	Tags []string `bson:"tags"`
+	N    int      `bson:"n"`
+}
+
+func TestTransactionsAreOptIn(t *testing.T) {
+	if _, ok := NewDatabase().(web.Transactional); ok {
+		t.Error("NewDatabase supports transactions, the real dal does not")
+	}
+	if _, ok := NewConnection().Clone().DB("app").(web.Transactional); ok {
+		t.Error("clone of NewConnection supports transactions")
+	}
+	if _, ok := NewTransactionalDatabase().(web.Transactional); !ok {
+		t.Error("NewTransactionalDatabase does not support transactions")
+	}
+	if _, ok := NewTransactionalConnection().Clone().DB("app").(web.Transactional); !ok {
+		t.Error("clone of NewTransactionalConnection does not support transactions")
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	db := NewTransactionalDatabase()
+	tx, err := db.(web.Transactional).Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DB().C("items").Insert(item{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	var got item
+	if err := db.C("items").FindID("a").One(&got); !errors.Is(err, dal.ErrNotFound) {
+		t.Errorf("rolled back insert is visible: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	col := NewDatabase().C("items")
+	col.Insert(item{ID: "a", Tags: []string{"x", "y"}, N: 1})
+
+	err := col.Update(dal.Q{"_id": "a", "tags": "x"},
+		dal.Q{"$pull": dal.Q{"tags": "x"}, "$inc": dal.Q{"n": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got item
+	col.FindID("a").One(&got)
+	if len(got.Tags) != 1 || got.Tags[0] != "y" || got.N != 2 {
+		t.Errorf("got %+v", got)
+	}
+
+	// the selector no longer matches, as for a conditional update which has
+	// already been applied
+	err = col.Update(dal.Q{"_id": "a", "tags": "x"}, dal.Q{"$pull": dal.Q{"tags": "x"}})
+	if !errors.Is(err, dal.ErrNotFound) {
+		t.Errorf("second update: %v", err)
+	}
+}
+
+func TestQueryChaining(t *testing.T) {
+	col := NewDatabase().C("items")
+	for _, id := range []string{"c", "a", "b"} {
+		col.Insert(item{ID: id})
+	}
+	var got []item
+	if err := col.Find(nil).Sort("-_id").Skip(1).Limit(1).All(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "b" {
+		t.Errorf("got %+v", got)
+	}
+	if n, _ := col.Find(dal.Q{"_id": dal.Q{"$gt": "a"}}).Count(); n != 2 {
+		t.Errorf("count %d", n)
+	}
+}
+
+// Operators the fake cannot match are reported rather than matching nothing
+func TestUnsupportedOperator(t *testing.T) {
+	col := NewDatabase().C("items")
+	col.Insert(item{ID: "a", Tags: []string{"x"}})
+
+	var got item
+	if err := col.Find(dal.Q{"tags": dal.Q{"$all": []string{"x"}}}).One(&got); err == nil {
+		t.Error("One matched an unsupported operator")
+	}
+	var all []item
+	if err := col.Find(dal.Q{"$or": []dal.Q{{"n": dal.Q{"$mod": []int{2, 0}}}}}).All(&all); err == nil {
+		t.Error("All matched an unsupported operator")
+	}
+	if _, err := col.Find(dal.Q{"$where": "this.n > 1"}).Count(); err == nil {
+		t.Error("Count matched an unsupported operator")
+	}
+	if _, err := col.RemoveAll(dal.Q{"n": dal.Q{"$type": "int"}}); err == nil {
+		t.Error("RemoveAll matched an unsupported operator")
+	}
+	err := col.Update(dal.Q{"_id": "a"}, dal.Q{"$pull": dal.Q{"tags": dal.Q{"$regex": "x"}}})
+	if err == nil {
+		t.Error("$pull matched an unsupported operator")
+	}
+}
+
+// A transaction only writes the documents it changed, so writes made
+// outside it while it ran are kept
+func TestTransactionCommit(t *testing.T) {
+	db := NewTransactionalDatabase()
+	items := db.C("items")
+	items.Insert(item{ID: "a", N: 1}, item{ID: "b", N: 1}, item{ID: "c", N: 1})
+
+	tx, err := db.(web.Transactional).Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txItems := tx.DB().C("items")
+	txItems.UpsertID("a", dal.Q{"$set": dal.Q{"n": 2}})
+	txItems.RemoveID("b")
+	txItems.Insert(item{ID: "d", N: 2})
+	tx.DB().C("logs").Insert(item{ID: "x"})
+
+	// written while the transaction runs
+	items.UpsertID("c", dal.Q{"$set": dal.Q{"n": 3}})
+	items.Insert(item{ID: "e", N: 3})
+	db.C("users").Insert(item{ID: "u"})
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var got []item
+	items.Find(nil).Sort("_id").All(&got)
+	want := map[string]int{"a": 2, "c": 3, "d": 2, "e": 3}
+	if len(got) != len(want) {
+		t.Errorf("got %+v", got)
+	}
+	for _, i := range got {
+		if n, ok := want[i.ID]; !ok || i.N != n {
+			t.Errorf("got %+v", i)
+		}
+	}
+	for _, c := range []string{"logs", "users"} {
+		if n, _ := db.C(c).Find(nil).Count(); n != 1 {
+			t.Errorf("%s has %d documents", c, n)
+		}
+	}
+}
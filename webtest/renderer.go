@@ -0,0 +1,88 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webtest
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"sync"
+)
+
+// Render records a single call to a Renderer
+type Render struct {
+	Format   string
+	Status   int
+	Template string
+	Binding  interface{}
+}
+
+// Renderer is a web.Renderer which records what it was asked to render.
+// JSON and XML are written to the response as usual, while HTML writes only
+// the status, so that handlers can be tested without their templates.
+type Renderer struct {
+	mu      sync.Mutex
+	renders []Render
+}
+
+// NewRenderer creates a Renderer with nothing recorded
+func NewRenderer() *Renderer {
+	return &Renderer{}
+}
+
+func (r *Renderer) record(render Render) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.renders = append(r.renders, render)
+}
+
+// Renders returns everything rendered so far, in order
+func (r *Renderer) Renders() []Render {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Render(nil), r.renders...)
+}
+
+// Last returns the most recent render, reporting false if there has been
+// none
+func (r *Renderer) Last() (Render, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.renders) == 0 {
+		return Render{}, false
+	}
+	return r.renders[len(r.renders)-1], true
+}
+
+func (r *Renderer) HTML(w http.ResponseWriter, status int, name string,
+	binding interface{}) {
+	r.record(Render{Format: "html", Status: status, Template: name, Binding: binding})
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(status)
+}
+
+func (r *Renderer) JSON(w http.ResponseWriter, status int, v interface{}) {
+	r.record(Render{Format: "json", Status: status, Binding: v})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (r *Renderer) XML(w http.ResponseWriter, status int, v interface{}) {
+	r.record(Render{Format: "xml", Status: status, Binding: v})
+	w.Header().Set("Content-Type", "text/xml; charset=UTF-8")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goincremental/dal"
+	"github.com/goincremental/web"
+	"github.com/goincremental/web/security"
+	"github.com/goincremental/web/security/models"
+)
+
+// Request builds a request for a test, with the values that middleware would
+// normally place on the request context already set.  Every request has a
+// Renderer, so that what a handler renders can be asserted on.
+type Request struct {
+	t        testing.TB
+	req      *http.Request
+	renderer *Renderer
+}
+
+// NewRequest creates a Request for the given method and target
+func NewRequest(t testing.TB, method, target string, body io.Reader) *Request {
+	req := httptest.NewRequest(method, target, body)
+	renderer := NewRenderer()
+	web.SetRenderer(req, renderer)
+	return &Request{t: t, req: req, renderer: renderer}
+}
+
+// WithDb makes db available through web.GetDb
+func (b *Request) WithDb(db dal.Database) *Request {
+	web.SetDb(b.req, db)
+	return b
+}
+
+// WithRenderer replaces the recording Renderer
+func (b *Request) WithRenderer(r web.Renderer) *Request {
+	web.SetRenderer(b.req, r)
+	return b
+}
+
+// WithSession makes s available through web.GetSession
+func (b *Request) WithSession(s web.Session) *Request {
+	web.SetSession(b.req, s)
+	return b
+}
+
+// WithUser logs the user in, making them available through
+// security.GetUser
+func (b *Request) WithUser(u *models.User) *Request {
+	security.SetUser(b.req, u)
+	return b
+}
+
+// WithHeader sets a request header
+func (b *Request) WithHeader(key, value string) *Request {
+	b.req.Header.Set(key, value)
+	return b
+}
+
+// WithJSON sets the body of the request to v encoded as JSON
+func (b *Request) WithJSON(v interface{}) *Request {
+	data, err := json.Marshal(v)
+	if err != nil {
+		b.t.Fatalf("webtest: unable to encode request body: %v", err)
+	}
+	b.req.Body = io.NopCloser(bytes.NewReader(data))
+	b.req.ContentLength = int64(len(data))
+	b.req.Header.Set("Content-Type", "application/json")
+	return b
+}
+
+// Request returns the built request
+func (b *Request) Request() *http.Request {
+	return b.req
+}
+
+// Serve runs the request through h, which may be a web.Server, a
+// web.Router or any other handler, and returns the recorded response
+func (b *Request) Serve(h http.Handler) *Response {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, b.req)
+	return &Response{ResponseRecorder: rec, t: b.t, renderer: b.renderer}
+}
+
+// ServeFunc runs the request through a handler function
+func (b *Request) ServeFunc(f func(http.ResponseWriter, *http.Request)) *Response {
+	return b.Serve(http.HandlerFunc(f))
+}
+
+// Response is the recorded response to a Request, with assertions which
+// report failures to the test the request was created with
+type Response struct {
+	*httptest.ResponseRecorder
+	t        testing.TB
+	renderer *Renderer
+}
+
+// AssertStatus checks the status code of the response
+func (r *Response) AssertStatus(want int) *Response {
+	r.t.Helper()
+	if r.Code != want {
+		r.t.Errorf("status = %d, want %d", r.Code, want)
+	}
+	return r
+}
+
+// AssertHeader checks a header of the response
+func (r *Response) AssertHeader(key, want string) *Response {
+	r.t.Helper()
+	if got := r.Header().Get(key); got != want {
+		r.t.Errorf("header %s = %q, want %q", key, got, want)
+	}
+	return r
+}
+
+// AssertRedirect checks the response redirects to location
+func (r *Response) AssertRedirect(location string) *Response {
+	r.t.Helper()
+	if r.Code < 300 || r.Code >= 400 {
+		r.t.Errorf("status = %d, want a redirect", r.Code)
+	}
+	return r.AssertHeader("Location", location)
+}
+
+// AssertBodyContains checks the body of the response contains s
+func (r *Response) AssertBodyContains(s string) *Response {
+	r.t.Helper()
+	if body := r.Body.String(); !strings.Contains(body, s) {
+		r.t.Errorf("body %q does not contain %q", body, s)
+	}
+	return r
+}
+
+// AssertJSON checks the body of the response is JSON equivalent to want,
+// which may be any value that encodes to JSON
+func (r *Response) AssertJSON(want interface{}) *Response {
+	r.t.Helper()
+	var got interface{}
+	if err := json.Unmarshal(r.Body.Bytes(), &got); err != nil {
+		r.t.Errorf("body is not JSON: %v", err)
+		return r
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		r.t.Fatalf("webtest: unable to encode expected JSON: %v", err)
+	}
+	var expected interface{}
+	json.Unmarshal(data, &expected)
+	if !reflect.DeepEqual(got, expected) {
+		r.t.Errorf("body = %s, want %s", strings.TrimSpace(r.Body.String()), data)
+	}
+	return r
+}
+
+// DecodeJSON decodes the body of the response into v
+func (r *Response) DecodeJSON(v interface{}) *Response {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body.Bytes(), v); err != nil {
+		r.t.Errorf("body is not JSON: %v", err)
+	}
+	return r
+}
+
+// AssertTemplate checks that name was the last template rendered by the
+// recording Renderer
+func (r *Response) AssertTemplate(name string) *Response {
+	r.t.Helper()
+	last, ok := r.renderer.Last()
+	switch {
+	case !ok || last.Format != "html":
+		r.t.Errorf("no template rendered, want %q", name)
+	case last.Template != name:
+		r.t.Errorf("template = %q, want %q", last.Template, name)
+	}
+	return r
+}
+
+// Renderer returns the recording Renderer used by the request
+func (r *Response) Renderer() *Renderer {
+	return r.renderer
+}
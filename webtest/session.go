@@ -0,0 +1,105 @@
+// Copyright 2014 GoIncremental Limited. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webtest
+
+import (
+	"sync"
+
+	sessions "github.com/goincremental/negroni-sessions"
+)
+
+const defaultFlashKey = "_flash"
+
+// Session is an in-memory web.Session whose values can be inspected after a
+// request has been served
+type Session struct {
+	mu          sync.Mutex
+	Values      map[interface{}]interface{}
+	Regenerated bool
+	Destroyed   bool
+	options     sessions.Options
+}
+
+// NewSession creates an empty Session
+func NewSession() *Session {
+	return &Session{Values: map[interface{}]interface{}{}}
+}
+
+func (s *Session) Get(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Values[key]
+}
+
+func (s *Session) Set(key interface{}, val interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values[key] = val
+}
+
+func (s *Session) Delete(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Values, key)
+}
+
+func (s *Session) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values = map[interface{}]interface{}{}
+}
+
+func (s *Session) AddFlash(value interface{}, vars ...string) {
+	key := flashKey(vars)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes, _ := s.Values[key].([]interface{})
+	s.Values[key] = append(flashes, value)
+}
+
+func (s *Session) Flashes(vars ...string) []interface{} {
+	key := flashKey(vars)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes, _ := s.Values[key].([]interface{})
+	delete(s.Values, key)
+	return flashes
+}
+
+func (s *Session) Options(options sessions.Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options = options
+}
+
+func (s *Session) Regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Regenerated = true
+}
+
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values = map[interface{}]interface{}{}
+	s.Destroyed = true
+}
+
+func flashKey(vars []string) string {
+	if len(vars) > 0 {
+		return vars[0]
+	}
+	return defaultFlashKey
+}